@@ -1,10 +1,17 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -13,7 +20,9 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -35,6 +44,9 @@ func setupTestDirs(t *testing.T) func() {
 	origDockerWorkspaceDir := dockerWorkspaceDir
 	origLoadedPlugins := loadedPlugins
 	origDigestConfigDir := digestConfigDir
+	origArtifactDir := artifactDir
+	origMediaDir := mediaDir
+	origImageOutputDir := imageServerOutputDir
 
 	tmp := t.TempDir()
 	threadDir = filepath.Join(tmp, "threads")
@@ -43,16 +55,28 @@ func setupTestDirs(t *testing.T) func() {
 	diagramDir = filepath.Join(tmp, "diagrams")
 	dockerWorkspaceDir = filepath.Join(tmp, "workspace")
 	digestConfigDir = tmp
+	artifactDir = filepath.Join(tmp, "artifacts")
+	mediaDir = filepath.Join(tmp, "media")
+	imageServerOutputDir = filepath.Join(tmp, "image_output")
 
 	os.MkdirAll(threadDir, 0755)
 	os.MkdirAll(pluginDir, 0755)
 	os.MkdirAll(playgroundDir, 0755)
 	os.MkdirAll(diagramDir, 0755)
 	os.MkdirAll(dockerWorkspaceDir, 0755)
+	os.MkdirAll(artifactDir, 0755)
+	os.MkdirAll(mediaDir, 0755)
 
 	loadedPlugins = nil
 
 	return func() {
+		// Let a background search index build finish before its dir goes away
+		searchIdxMu.Lock()
+		ix := searchIdx
+		searchIdxMu.Unlock()
+		if ix != nil {
+			<-ix.ready
+		}
 		threadDir = origThreadDir
 		pluginDir = origPluginDir
 		playgroundDir = origPlaygroundDir
@@ -60,6 +84,9 @@ func setupTestDirs(t *testing.T) func() {
 		dockerWorkspaceDir = origDockerWorkspaceDir
 		loadedPlugins = origLoadedPlugins
 		digestConfigDir = origDigestConfigDir
+		artifactDir = origArtifactDir
+		mediaDir = origMediaDir
+		imageServerOutputDir = origImageOutputDir
 	}
 }
 
@@ -212,6 +239,15 @@ func newFlushRecorder() *flushRecorder {
 	return &flushRecorder{httptest.NewRecorder()}
 }
 
+func mustReadFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
 // ============================================================================
 // 1. Pure Function Tests — Config
 // ============================================================================
@@ -958,448 +994,3596 @@ func TestLoadThread_BackwardCompatMigration(t *testing.T) {
 	}
 }
 
-// ============================================================================
-// 7. Plugin System Tests
-// ============================================================================
-
-func TestSaveAndLoadPlugins(t *testing.T) {
+func TestListThreads_MetaIndex(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
-	plugin := Plugin{
-		Name:        "test-plugin",
-		Description: "A test plugin",
-		Version:     "1.0",
-		Tested:      true,
-		Tool: &PluginTool{
-			Description: "Does things",
-			Parameters:  map[string]interface{}{"type": "object"},
-			Code:        "console.log('hello');",
-		},
-	}
-	if err := savePlugin(plugin); err != nil {
-		t.Fatal(err)
-	}
+	saveThreadMeta(&Thread{ID: "m1", Title: "Indexed", UpdatedAt: time.Now()})
+	saveThreadMeta(&Thread{ID: "m2", Title: "Other", UpdatedAt: time.Now()})
 
-	if err := loadPlugins(); err != nil {
-		t.Fatal(err)
+	// Listing after a restart is served from the index file
+	threadMetaCache = nil
+	items, _ := listThreads()
+	if len(items) != 2 {
+		t.Fatalf("expected 2 threads, got %d", len(items))
 	}
-	if len(loadedPlugins) != 1 {
-		t.Fatalf("expected 1 plugin, got %d", len(loadedPlugins))
+
+	// A file rewritten outside saveThreadMeta is re-read (mtime differs)
+	time.Sleep(10 * time.Millisecond)
+	data, _ := json.Marshal(Thread{ID: "m1", Title: "Edited on disk"})
+	os.WriteFile(filepath.Join(threadDir, "m1.json"), data, 0644)
+	os.Remove(filepath.Join(threadDir, "m2.json"))
+	items, _ = listThreads()
+	if len(items) != 1 || items[0].Title != "Edited on disk" {
+		t.Fatalf("expected the edited thread only, got %+v", items)
 	}
-	if loadedPlugins[0].Name != "test-plugin" || loadedPlugins[0].Tool == nil {
-		t.Errorf("unexpected plugin: %+v", loadedPlugins[0])
+	threadMetaCache = nil
+	if idx := loadThreadMetaIndex(); len(idx) != 1 || idx["m1"].Item.Title != "Edited on disk" {
+		t.Errorf("index should persist the refresh: %+v", idx)
 	}
 }
 
-func TestDeletePluginFile(t *testing.T) {
+func TestThreadSearchIndex(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
+	origMax := searchJournalMaxDocs
+	searchJournalMaxDocs = 3
+	defer func() { searchJournalMaxDocs = origMax }()
 
-	savePlugin(Plugin{Name: "doomed", Description: "will die", Version: "1.0"})
-	if err := deletePluginFile("doomed"); err != nil {
+	now := time.Now()
+	saveThreadMeta(&Thread{ID: "chat-1", Title: "Go debugging", UpdatedAt: now})
+	saveThreadMeta(&Thread{ID: idleThreadIDPrefix + "2024-01-01", Title: "idle", UpdatedAt: now})
+	appendToLog("chat-1", ThreadMessage{Role: "user", Content: "The goroutine leak crashes the server", Timestamp: now.Unix()})
+	appendToLog("chat-1", ThreadMessage{Role: "assistant", EventType: "thinking", Content: "goroutine leak", Timestamp: now.Unix()})
+	appendToLog("chat-1", ThreadMessage{Role: "tool", ToolName: "grep", Content: "found goroutine in server.go", Timestamp: now.Unix()})
+	appendToLog("chat-1", ThreadMessage{Role: "user", Content: "データベースの接続エラーを調べて", Timestamp: now.AddDate(0, 0, -10).Unix()})
+	appendToLog(idleThreadIDPrefix+"2024-01-01", ThreadMessage{Role: "assistant", Content: "Thinking about goroutine scheduling", Timestamp: now.Unix()})
+
+	hits, total, err := searchThreads(SearchQuery{Text: "goroutine leak"})
+	if err != nil {
 		t.Fatal(err)
 	}
-	loadPlugins()
-	if len(loadedPlugins) != 0 {
-		t.Errorf("expected 0 plugins after delete, got %d", len(loadedPlugins))
+	if total != 3 || hits[0].Thread != "chat-1" || hits[0].Index != 0 || !strings.Contains(hits[0].Snippet, "goroutine leak") {
+		t.Fatalf("expected the leak message first, got total=%d %+v", total, hits)
 	}
-}
 
-func TestGetAllTools_WithPlugin(t *testing.T) {
-	cleanup := setupTestDirs(t)
-	defer cleanup()
+	// CJK bigrams match inside an unsegmented sentence
+	hits, _, _ = searchThreads(SearchQuery{Text: "接続エラー"})
+	if len(hits) != 1 || hits[0].Index != 3 {
+		t.Errorf("expected the Japanese message at index 3, got %+v", hits)
+	}
 
-	// Load a plugin with a tool
-	loadedPlugins = []Plugin{
-		{
-			Name:    "myplugin",
-			Version: "1.0",
-			Tested:  true,
-			Tool: &PluginTool{
-				Description: "My tool",
-				Parameters:  map[string]interface{}{"type": "object"},
-				Code:        "console.log('test');",
-			},
-		},
+	// Filters
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine", Tool: "grep"}); len(hits) != 1 || hits[0].Role != "tool" {
+		t.Errorf("tool filter: %+v", hits)
+	}
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine", Type: "idle"}); len(hits) != 1 || hits[0].Type != "idle" {
+		t.Errorf("type filter: %+v", hits)
+	}
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine", Type: "user", Role: "user"}); len(hits) != 1 {
+		t.Errorf("role filter: %+v", hits)
+	}
+	if hits, _, _ := searchThreads(SearchQuery{Text: "データベース", To: now.AddDate(0, 0, -20)}); len(hits) != 0 {
+		t.Errorf("date filter should exclude newer messages: %+v", hits)
 	}
 
-	allTools := getAllTools()
-	found := false
-	for _, tool := range allTools {
-		if tool.Name == "plugin_myplugin" {
-			found = true
-			break
-		}
+	// The index survives a restart (segments + journal) and honours deletes
+	searchIdx = nil
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine"}); len(hits) != 3 {
+		t.Errorf("expected 3 hits after reload, got %+v", hits)
 	}
-	if !found {
-		t.Error("expected plugin_myplugin in all tools")
+	if err := deleteThread("chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	searchIdx = nil
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine"}); len(hits) != 1 || hits[0].Type != "idle" {
+		t.Errorf("deleted thread should not match: %+v", hits)
+	}
+	// A recreated thread with the same id is searchable again
+	saveThreadMeta(&Thread{ID: "chat-1", Title: "Again", UpdatedAt: now})
+	appendToLog("chat-1", ThreadMessage{Role: "user", Content: "goroutine again", Timestamp: now.Unix()})
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine", Thread: "chat-1"}); len(hits) != 1 || hits[0].Index != 0 {
+		t.Errorf("recreated thread: %+v", hits)
+	}
+
+	// A missing manifest triggers a rebuild from the logs
+	os.RemoveAll(threadIndexDir())
+	searchIdx = nil
+	threadMetaCache = nil
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine"}); len(hits) != 2 {
+		t.Errorf("expected 2 hits after rebuild, got %+v", hits)
+	}
+
+	// Writes during a build queue instead of waiting; each message is indexed once
+	ix := newThreadSearchIndex()
+	ix.building = true
+	searchIdx = ix
+	appendToLog("chat-1", ThreadMessage{Role: "user", Content: "goroutine queued", Timestamp: now.Unix()})
+	appendToLog("chat-new", ThreadMessage{Role: "user", Content: "first", Timestamp: now.Unix()})
+	appendToLog("chat-new", ThreadMessage{Role: "user", Content: "goroutine second", Timestamp: now.Unix()})
+	if len(ix.pending) != 3 {
+		t.Fatalf("expected 3 queued messages, got %d", len(ix.pending))
+	}
+	ix.rebuild(getThreadStore())
+	saveThreadMeta(&Thread{ID: "chat-new", Title: "New", UpdatedAt: now})
+	threadMetaCache = nil
+	if hits, _, _ := searchThreads(SearchQuery{Text: "goroutine"}); len(hits) != 4 {
+		t.Errorf("expected 4 hits after queued appends, got %+v", hits)
+	}
+	if hits, _, _ := searchThreads(SearchQuery{Text: "second"}); len(hits) != 1 || hits[0].Thread != "chat-new" || hits[0].Index != 1 {
+		t.Errorf("queued message should keep its log index: %+v", hits)
 	}
 }
 
-func TestGetAllTools_SkipsDisabledPlugin(t *testing.T) {
+func TestAppendToLog_ConcurrentKeepsLogIndex(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
-	disabled := false
-	loadedPlugins = []Plugin{
-		{
-			Name:    "disabled-plugin",
-			Version: "1.0",
-			Enabled: &disabled,
-			Tested:  true,
-			Tool: &PluginTool{
-				Description: "Disabled tool",
-				Parameters:  map[string]interface{}{"type": "object"},
-				Code:        "console.log('nope');",
-			},
-		},
-	}
-
-	allTools := getAllTools()
-	for _, tool := range allTools {
-		if tool.Name == "plugin_disabled-plugin" {
-			t.Error("disabled plugin should not appear in tools")
+	saveThreadMeta(&Thread{ID: "busy", Title: "Busy", UpdatedAt: time.Now()})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			appendToLog("busy", ThreadMessage{Role: "user", Content: fmt.Sprintf("marker%d", i), Timestamp: time.Now().Unix()})
+		}(i)
+	}
+	wg.Wait()
+
+	msgs, _ := loadThreadMessages("busy")
+	for i, m := range msgs {
+		hits, _, _ := searchThreads(SearchQuery{Text: m.Content})
+		if len(hits) != 1 || hits[0].Index != i {
+			t.Errorf("%s at log line %d: %+v", m.Content, i, hits)
 		}
 	}
 }
 
-// ============================================================================
-// 8. HTTP Handler Tests
-// ============================================================================
-
-func TestHandleStatus(t *testing.T) {
+func TestHandleSearch(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
-	defer server.Close()
-	cfg := testConfig(server.URL)
-	ws := NewWebServer(cfg)
+	saveThreadMeta(&Thread{ID: "s1", Title: "Search", UpdatedAt: time.Now()})
+	appendToLog("s1", ThreadMessage{Role: "user", Content: "kubernetes deployment failed", Timestamp: time.Now().Unix()})
 
-	req := httptest.NewRequest("GET", "/api/status", nil)
+	ws := &WebServer{config: &Config{}}
+	req := httptest.NewRequest("GET", "/api/search?q=kubernetes&role=user&from=2000-01-01", nil)
 	w := httptest.NewRecorder()
-	ws.handleStatus(w, req)
-
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+	ws.handleSearch(w, req)
+	var resp struct {
+		Hits  []SearchHit `json:"hits"`
+		Total int         `json:"total"`
 	}
-	var resp StatusResponse
 	json.NewDecoder(w.Body).Decode(&resp)
-	if resp.Model != "test-model" || resp.Backend != "ollama" || resp.Version != Version {
-		t.Errorf("unexpected status: %+v", resp)
+	if resp.Total != 1 || resp.Hits[0].Thread != "s1" || resp.Hits[0].Title != "Search" {
+		t.Errorf("unexpected response: %+v", resp)
 	}
-	if resp.VisionModel != "test-vision" {
-		t.Errorf("expected vision model, got %q", resp.VisionModel)
+
+	w = httptest.NewRecorder()
+	ws.handleSearch(w, httptest.NewRequest("GET", "/api/search?q=x&from=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad date, got %d", w.Code)
+	}
+
+	// recall_context and search_threads go through the index
+	agent := &Agent{config: &Config{}, threadID: "s1"}
+	out, _ := agent.recallContext("deployment")
+	if !strings.Contains(out, "[#1 ") || !strings.Contains(out, "kubernetes deployment failed") {
+		t.Errorf("recall_context: %s", out)
+	}
+	out, _ = agent.searchAllThreads("kubernetes")
+	if !strings.Contains(out, "**Thread: Search** (s1) - 1 matches") {
+		t.Errorf("search_threads: %s", out)
 	}
 }
 
-func TestHandleThreads_CRUD(t *testing.T) {
+func TestThreadExportImport(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
-	defer server.Close()
-	cfg := testConfig(server.URL)
-	ws := NewWebServer(cfg)
+	created := time.Date(2024, 5, 1, 9, 30, 0, 0, time.Local)
+	saveThreadMeta(&Thread{ID: "exp-1", Title: "Chart work", CreatedAt: created, UpdatedAt: created, MessageCount: 5})
+	os.WriteFile(filepath.Join(playgroundDir, "chart.png"), []byte("PNGDATA"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "demo.html"), []byte("<p>demo</p>"), 0644)
+	artifactID, _ := saveArtifact(strings.Repeat("row\n", 10), "grep")
+	msgs := []ThreadMessage{
+		{Role: "user", Content: "Plot this", Images: []string{"aW1n"}, Timestamp: created.Unix()},
+		{Role: "assistant", EventType: "thinking", Content: "secret reasoning", Timestamp: created.Unix() + 1},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "c1", Function: ToolCallFunc{Name: "run_code", Arguments: `{"code":"plot()"}`}}}, Timestamp: created.Unix() + 2},
+		{Role: "tool", ToolName: "run_code", ToolCallID: "c1", Content: "saved <chart>", ArtifactID: artifactID, Timestamp: created.Unix() + 3},
+		{Role: "assistant", Content: "Done: ![chart](/playground/chart.png) and [demo](/playground/demo.html) [x](javascript:alert(1))", Timestamp: created.Unix() + 4},
+	}
+	for _, m := range msgs {
+		appendToLog("exp-1", m)
+	}
 
-	// Create
-	body := `{"id":"th-1","title":"Test"}`
-	req := httptest.NewRequest("POST", "/api/threads", strings.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	if w.Code != 200 {
-		t.Errorf("create: expected 200, got %d", w.Code)
+	md, _, name, err := exportThread("exp-1", ThreadExportOptions{Format: "md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# Chart work", "## 👤 User", "![image 1](data:image/png;base64,aW1n)", "**🔧 run_code**", "<details><summary>🔧 Tool: run_code", "## Attachments", "![chart](data:image/png;base64,UE5HREFUQQ==)", "<details><summary>demo.html</summary>\n\n```html\n<p>demo</p>\n```"} {
+		if !strings.Contains(string(md), want) {
+			t.Errorf("markdown missing %q:\n%s", want, md)
+		}
+	}
+	if name != "exp-1.md" || strings.Contains(string(md), "secret reasoning") {
+		t.Errorf("thinking must be opt-in (name %s)", name)
 	}
 
-	// List
-	req = httptest.NewRequest("GET", "/api/threads", nil)
-	w = httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	var threads []ThreadListItem
-	json.NewDecoder(w.Body).Decode(&threads)
-	if len(threads) != 1 || threads[0].ID != "th-1" {
-		t.Errorf("list unexpected: %+v", threads)
+	page, _, _, _ := exportThread("exp-1", ThreadExportOptions{Format: "html", Thinking: true})
+	for _, want := range []string{"<details class=\"tool\"><summary>🔧 run_code</summary>", "saved &lt;chart&gt;", "src=\"data:image/png;base64,UE5HREFUQQ==\"", "secret reasoning", "srcdoc=\"&lt;p&gt;demo&lt;/p&gt;\"", `<a href="#">x</a>`} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("html missing %q", want)
+		}
+	}
+	if _, _, _, err := exportThread("exp-1", ThreadExportOptions{Format: "pdf"}); err == nil {
+		t.Error("expected an error for an unknown format")
 	}
 
-	// Get single
-	req = httptest.NewRequest("GET", "/api/threads/th-1", nil)
-	w = httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	var thread Thread
-	json.NewDecoder(w.Body).Decode(&thread)
-	if thread.ID != "th-1" || thread.Title != "Test" {
-		t.Errorf("get unexpected: %+v", thread)
+	bundle, _, _, err := exportThread("exp-1", ThreadExportOptions{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Rename (POST not PUT)
-	req = httptest.NewRequest("POST", "/api/threads/th-1/rename", strings.NewReader(`{"title":"Renamed"}`))
-	req.Header.Set("Content-Type", "application/json")
-	w = httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	if w.Code != 200 {
-		t.Errorf("rename: expected 200, got %d: %s", w.Code, w.Body.String())
+	// Move to a "new machine": wipe the thread, its files and artifacts
+	deleteThread("exp-1")
+	os.Remove(filepath.Join(playgroundDir, "chart.png"))
+	os.Remove(filepath.Join(playgroundDir, "demo.html"))
+	os.RemoveAll(artifactDir)
+	os.MkdirAll(artifactDir, 0755)
+
+	imported, err := importThread(bundle)
+	if err != nil {
+		t.Fatal(err)
 	}
-	meta, _ := loadThreadMeta("th-1")
-	if meta.Title != "Renamed" {
-		t.Errorf("expected 'Renamed', got %q", meta.Title)
+	if imported.ID != "exp-1" {
+		t.Errorf("expected the original id, got %s", imported.ID)
+	}
+	got, err := loadThread("exp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != len(msgs) || !got.CreatedAt.Equal(created) || got.Messages[4].Timestamp != created.Unix()+4 || got.Messages[2].ToolCalls[0].Function.Name != "run_code" {
+		t.Errorf("thread not restored faithfully: %+v", got)
+	}
+	if data, _ := os.ReadFile(filepath.Join(playgroundDir, "chart.png")); string(data) != "PNGDATA" {
+		t.Error("linked playground file should be restored")
+	}
+	if _, err := os.Stat(filepath.Join(playgroundDir, "demo.html")); err == nil {
+		t.Error("pages from a bundle must not be restored")
+	}
+	if content, _, err := loadArtifact(artifactID); err != nil || !strings.HasPrefix(content, "row\n") {
+		t.Errorf("artifact should be restored: %v", err)
 	}
 
-	// Delete
-	req = httptest.NewRequest("DELETE", "/api/threads/th-1", nil)
-	w = httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	if w.Code != 200 {
-		t.Errorf("delete: expected 200, got %d", w.Code)
+	// Importing again must not clobber the existing thread
+	again, err := importThread(bundle)
+	if err != nil || again.ID == "exp-1" || !strings.HasPrefix(again.ID, "exp-1-imported-") {
+		t.Errorf("expected a fresh id, got %+v %v", again, err)
 	}
-	threads2, _ := listThreads()
-	if len(threads2) != 0 {
-		t.Error("thread should be deleted")
+	if _, err := importThread([]byte(`{"format":"other"}`)); err == nil {
+		t.Error("expected an error for a foreign bundle")
 	}
 }
 
-func TestHandleThreads_GetNotFound(t *testing.T) {
+func TestHandleThreads_ExportImport(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
+	ws := &WebServer{config: &Config{}, conversations: make(map[string]*Agent)}
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
-	defer server.Close()
-	ws := NewWebServer(testConfig(server.URL))
+	saveThreadMeta(&Thread{ID: "h1", Title: "Hello", CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	appendToLog("h1", ThreadMessage{Role: "user", Content: "hi", Timestamp: time.Now().Unix()})
 
-	req := httptest.NewRequest("GET", "/api/threads/nonexistent", nil)
 	w := httptest.NewRecorder()
-	ws.handleThreads(w, req)
-	if w.Code != 404 {
-		t.Errorf("expected 404, got %d", w.Code)
+	ws.handleThreads(w, httptest.NewRequest("GET", "/api/threads/h1/export?format=json", nil))
+	if w.Code != 200 || !strings.Contains(w.Header().Get("Content-Disposition"), "h1.json") {
+		t.Fatalf("export failed: %d %v", w.Code, w.Header())
 	}
-}
-
-func TestHandlePlugins_List(t *testing.T) {
-	cleanup := setupTestDirs(t)
-	defer cleanup()
+	bundle := w.Body.Bytes()
 
-	loadedPlugins = []Plugin{
-		{Name: "p1", Description: "Plugin 1", Version: "1.0"},
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, httptest.NewRequest("GET", "/api/threads/missing/export", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
 	}
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
-	defer server.Close()
-	ws := NewWebServer(testConfig(server.URL))
-
-	req := httptest.NewRequest("GET", "/api/plugins", nil)
-	w := httptest.NewRecorder()
-	ws.handlePlugins(w, req)
-
-	var plugins []Plugin
-	json.NewDecoder(w.Body).Decode(&plugins)
-	if len(plugins) != 1 || plugins[0].Name != "p1" {
-		t.Errorf("unexpected plugins: %+v", plugins)
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, httptest.NewRequest("POST", "/api/threads/import", bytes.NewReader(bundle)))
+	var got Thread
+	json.NewDecoder(w.Body).Decode(&got)
+	if w.Code != 200 || got.Title != "Hello" || got.ID == "h1" {
+		t.Errorf("import failed: %d %+v", w.Code, got)
 	}
 }
 
-func TestHandleUpload_SingleFile(t *testing.T) {
+func TestThreadFork(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
+	server := mockLLMServer(t, streamingLLMResponse([]string{"Branch", " answer"}))
 	defer server.Close()
 	ws := NewWebServer(testConfig(server.URL))
 
-	// Create multipart form
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
-	part, _ := writer.CreateFormFile("files", "test.txt")
-	part.Write([]byte("hello world"))
-	writer.Close()
+	now := time.Now()
+	saveThreadMeta(&Thread{ID: "p1", Title: "Trip", CreatedAt: now, UpdatedAt: now})
+	for _, m := range []ThreadMessage{
+		{Role: "user", Content: "plan a trip"},
+		{Role: "assistant", Content: "where to?"},
+		{Role: "user", Content: "kyoto"},
+		{Role: "assistant", Content: "ok, kyoto"},
+	} {
+		appendToLog("p1", m)
+	}
 
-	req := httptest.NewRequest("POST", "/api/upload", &buf)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	// A non-user index needs a replacement message
 	w := httptest.NewRecorder()
-	ws.handleUpload(w, req)
+	ws.handleThreads(w, httptest.NewRequest("POST", "/api/threads/p1/fork", strings.NewReader(`{"index":1}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for assistant index, got %d", w.Code)
+	}
 
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	fw := newFlushRecorder()
+	ws.handleThreads(fw, httptest.NewRequest("POST", "/api/threads/p1/fork", strings.NewReader(`{"index":2,"message":"osaka","stream":true}`)))
+	branchID := fw.Header().Get("X-Thread-Id")
+	if branchID == "" || !strings.Contains(fw.Body.String(), `"type":"content"`) {
+		t.Fatalf("expected streamed branch run, got %q: %s", branchID, fw.Body.String())
 	}
 
-	// Check file exists in workspace
-	content, err := os.ReadFile(filepath.Join(dockerWorkspaceDir, "test.txt"))
+	branch, err := loadThread(branchID)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(content) != "hello world" {
-		t.Errorf("file content = %q", content)
+	if branch.ParentID != "p1" || branch.ForkIndex != 2 {
+		t.Errorf("unexpected branch links: %+v", branch)
+	}
+	if len(branch.Messages) < 4 || branch.Messages[1].Content != "where to?" || branch.Messages[2].Content != "osaka" {
+		t.Errorf("expected parent prefix then edited message, got %+v", branch.Messages)
+	}
+	parent, _ := loadThreadMeta("p1")
+	if len(parent.Children) != 1 || parent.Children[0] != branchID {
+		t.Errorf("expected parent to list the branch, got %v", parent.Children)
+	}
+	items, _ := listThreads()
+	for _, it := range items {
+		if it.ID == branchID && it.ParentID != "p1" {
+			t.Errorf("thread list should carry parent_id: %+v", it)
+		}
+	}
+
+	deleteThread(branchID)
+	parent, _ = loadThreadMeta("p1")
+	if len(parent.Children) != 0 {
+		t.Errorf("expected branch unlinked after delete, got %v", parent.Children)
+	}
+
+	// Deleting the parent leaves its branches as top-level threads
+	orphan, _, err := forkThread("p1", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteThread("p1")
+	if got, _ := loadThreadMeta(orphan.ID); got == nil || got.ParentID != "" || got.ForkIndex != 0 {
+		t.Errorf("expected branch detached from the deleted parent: %+v", got)
 	}
 }
 
-func TestHandleSettings_SetProviders(t *testing.T) {
+func TestThreadOrganization(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
+	ws := &WebServer{config: &Config{}, conversations: make(map[string]*Agent)}
+
+	base := time.Now().Add(-time.Hour)
+	for i, id := range []string{"o1", "o2", "o3"} {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		saveThreadMeta(&Thread{ID: id, Title: "Thread " + id, CreatedAt: ts, UpdatedAt: ts, SuggestedTags: []string{"travel"}})
+	}
+
+	patch := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ws.handleThreads(w, httptest.NewRequest("PATCH", path, strings.NewReader(body)))
+		return w
+	}
+	list := func(query string) []ThreadListItem {
+		w := httptest.NewRecorder()
+		ws.handleThreads(w, httptest.NewRequest("GET", "/api/threads"+query, nil))
+		var items []ThreadListItem
+		json.NewDecoder(w.Body).Decode(&items)
+		return items
+	}
+	ids := func(items []ThreadListItem) string {
+		var out []string
+		for _, it := range items {
+			out = append(out, it.ID)
+		}
+		return strings.Join(out, ",")
+	}
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
+	w := patch("/api/threads/o1", `{"add_tags":["#Travel"," Kyoto Trip "],"folder":"/work//plans/","pinned":true}`)
+	var got Thread
+	json.NewDecoder(w.Body).Decode(&got)
+	if w.Code != 200 || strings.Join(got.Tags, ",") != "travel,kyoto-trip" || got.Folder != "work/plans" || !got.Pinned {
+		t.Fatalf("unexpected patch result: %d %+v", w.Code, got)
+	}
+	if len(got.SuggestedTags) != 0 {
+		t.Errorf("accepted suggestion should be cleared, got %v", got.SuggestedTags)
+	}
+	if w := patch("/api/threads", `{"ids":["o2","o3"],"folder":"work"}`); w.Code != 200 {
+		t.Fatalf("bulk patch failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := patch("/api/threads/o3", `{"archived":true}`); w.Code != 200 {
+		t.Fatalf("archive failed: %d", w.Code)
+	}
+	if w := patch("/api/threads/missing", `{"pinned":true}`); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+
+	// Pinned first, archived hidden by default
+	if got := ids(list("")); got != "o1,o2" {
+		t.Errorf("default list: got %s", got)
+	}
+	if got := ids(list("?archived=1")); got != "o3" {
+		t.Errorf("archived list: got %s", got)
+	}
+	if got := ids(list("?folder=work&archived=all&sort=created&order=asc")); got != "o1,o2,o3" {
+		t.Errorf("folder list: got %s", got)
+	}
+	if got := ids(list("?folder=work/plans")); got != "o1" {
+		t.Errorf("subfolder list: got %s", got)
+	}
+	if got := ids(list("?tag=travel&tag=kyoto-trip")); got != "o1" {
+		t.Errorf("tag list: got %s", got)
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, httptest.NewRequest("GET", "/api/threads/tags", nil))
+	var facets map[string][]ThreadFacet
+	json.NewDecoder(w.Body).Decode(&facets)
+	if len(facets["folders"]) != 2 || facets["folders"][0] != (ThreadFacet{Name: "work", Count: 2}) {
+		t.Errorf("unexpected folder facets: %+v", facets["folders"])
+	}
+
+	// Title model suggests tags in the same reply
+	server := mockLLMServer(t, staticLLMResponse("「京都旅行」\nタグ: Travel, 京都"))
+	defer server.Close()
+	generateThreadTitle(testConfig(server.URL), "o2", "京都に行きたい", "")
+	meta, _ := loadThreadMeta("o2")
+	if meta.Title != "京都旅行" || strings.Join(meta.SuggestedTags, ",") != "travel,京都" {
+		t.Errorf("unexpected title/tags: %q %v", meta.Title, meta.SuggestedTags)
+	}
+}
+
+func TestThreadStore_Contract(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	for name, store := range map[string]ThreadStore{
+		"fs":     newFSThreadStore(threadDir),
+		"memory": newMemoryThreadStore(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.LoadMeta("s1"); err == nil {
+				t.Fatal("expected error for missing thread")
+			}
+			if _, err := store.UpdateMeta("s1", false, func(*Thread) error { return nil }); err == nil {
+				t.Fatal("UpdateMeta without create should fail for a missing thread")
+			}
+			if err := store.SaveMeta(&Thread{ID: "s1", Title: "One", Messages: []ThreadMessage{{Role: "user"}}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Append("s1", ThreadMessage{Role: "user", Content: "a"}, ThreadMessage{Role: "assistant", Content: "b"}); err != nil {
+				t.Fatal(err)
+			}
+			meta, _ := store.LoadMeta("s1")
+			if meta.Title != "One" || len(meta.Messages) != 0 {
+				t.Errorf("SaveMeta should store metadata only: %+v", meta)
+			}
+			msgs, _ := store.LoadMessages("s1")
+			if len(msgs) != 2 || msgs[1].Content != "b" || store.LogLen("s1") != 2 {
+				t.Errorf("unexpected log: %+v", msgs)
+			}
+			if st, err := store.Stat("s1"); err != nil || st.Size == 0 {
+				t.Errorf("Stat: %+v %v", st, err)
+			}
+			if _, err := store.Stat("missing"); err == nil {
+				t.Error("Stat should fail for a missing thread")
+			}
+			got, err := store.UpdateMeta("s2", true, func(t *Thread) error {
+				t.Title = "Two"
+				return nil
+			})
+			if err != nil || got.ID != "s2" || got.Title != "Two" {
+				t.Fatalf("UpdateMeta create: %+v %v", got, err)
+			}
+			store.Append("s3", ThreadMessage{Role: "user", Content: "log only"})
+			ids, _ := store.IDs()
+			if strings.Join(ids, ",") != "s1,s2,s3" || !store.Exists("s3") {
+				t.Errorf("unexpected ids: %v", ids)
+			}
+			items, _ := store.List()
+			if len(items) != 2 {
+				t.Errorf("List should return threads with metadata, got %+v", items)
+			}
+			if err := store.Delete("s1"); err != nil || store.Exists("s1") || store.LogLen("s1") != 0 {
+				t.Errorf("Delete failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestFSThreadStore_ConcurrentWriters(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	saveThreadMeta(&Thread{ID: "busy", Title: "Busy", CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			appendMessageToThread("busy", Message{Role: "assistant", Content: fmt.Sprintf("msg %d %s", i, strings.Repeat("x", 5000))}, "")
+		}(i)
+	}
+	wg.Wait()
+
+	meta, _ := loadThreadMeta("busy")
+	if meta.MessageCount != 40 {
+		t.Errorf("expected 40 counted messages, got %d (lost updates)", meta.MessageCount)
+	}
+	msgs, _ := loadThreadMessages("busy")
+	if len(msgs) != 40 {
+		t.Errorf("expected 40 intact log lines, got %d", len(msgs))
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(threadDir, ".*.tmp")); len(tmps) != 0 {
+		t.Errorf("temp files left behind: %v", tmps)
+	}
+}
+
+func TestThreadHelpers_MemoryStore(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	restore := useThreadStore(newMemoryThreadStore())
+	defer restore()
+
+	appendMessageToThread("m1", Message{Role: "user", Content: "hello memory"}, "")
+	appendMessageToThread("m1", Message{Role: "assistant", Content: "hi"}, "")
+	if _, err := os.Stat(filepath.Join(threadDir, "m1.jsonl")); err == nil {
+		t.Error("memory store should not write thread files")
+	}
+	th, err := loadThread("m1")
+	if err != nil || th.Title != "hello memory" || th.MessageCount != 2 || len(th.Messages) != 2 {
+		t.Fatalf("unexpected thread: %+v %v", th, err)
+	}
+	if _, err := patchThread("m1", ThreadPatch{AddTags: []string{"demo"}}); err != nil {
+		t.Fatal(err)
+	}
+	items, _ := listThreads()
+	if len(items) != 1 || items[0].Tags[0] != "demo" {
+		t.Errorf("unexpected list: %+v", items)
+	}
+	if err := deleteThread("m1"); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := listThreads(); len(items) != 0 {
+		t.Errorf("expected empty list after delete, got %+v", items)
+	}
+}
+
+func TestParseRetentionAge(t *testing.T) {
+	for in, want := range map[string]time.Duration{"7d": 7 * 24 * time.Hour, "2w": 14 * 24 * time.Hour, "12h": 12 * time.Hour, "1.5d": 36 * time.Hour} {
+		if got, err := parseRetentionAge(in); err != nil || got != want {
+			t.Errorf("parseRetentionAge(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseRetentionAge("soon"); err == nil {
+		t.Error("expected error for invalid age")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("TMPDIR", t.TempDir())
+
+	old := time.Now().AddDate(0, 0, -30)
+	for _, th := range []*Thread{
+		{ID: idleThreadIDPrefix + "2000-01-01", Title: "old idle", CreatedAt: old, UpdatedAt: old},
+		{ID: idleThreadIDPrefix + "today", Title: "new idle", CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		{ID: "u-old", Title: "old", CreatedAt: old, UpdatedAt: old},
+		{ID: "u-pinned", Title: "pinned", CreatedAt: old, UpdatedAt: old, Pinned: true},
+	} {
+		saveThreadMeta(th)
+		appendToLog(th.ID, ThreadMessage{Role: "user", Content: th.Title})
+	}
+	os.WriteFile(filepath.Join(playgroundDir, "image_archived.png"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "image_idle.png"), []byte("i"), 0644)
+	registerMedia(MediaItem{File: "image_archived.png", ThreadID: "u-old"})
+	registerMedia(MediaItem{File: "image_idle.png", ThreadID: idleThreadIDPrefix + "2000-01-01"})
+	for i, name := range []string{"a.json", "b.json", "c.json"} {
+		path := filepath.Join(planDir(), name)
+		os.WriteFile(path, []byte(`{"goal":"x"}`), 0644)
+		ts := time.Now().Add(-time.Duration(3-i) * time.Hour)
+		os.Chtimes(path, ts, ts)
+	}
+
+	ws := &WebServer{config: &Config{}, conversations: make(map[string]*Agent)}
+	w := httptest.NewRecorder()
+	ws.handleStorage(w, httptest.NewRequest("PUT", "/api/storage", strings.NewReader(`{"rules":{"plans":{"action":"shred"}}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad action, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ws.handleStorage(w, httptest.NewRequest("PUT", "/api/storage", strings.NewReader(`{"rules":{"plans":{"max_count":1,"action":"archive"},"threads":{"max_age":"7d","action":"archive"}}}`)))
+	if w.Code != 200 {
+		t.Fatalf("saving rules failed: %d %s", w.Code, w.Body.String())
+	}
+	var usage struct {
+		Classes []RetentionResult `json:"classes"`
+	}
+	json.NewDecoder(w.Body).Decode(&usage)
+	byClass := map[string]RetentionResult{}
+	for _, c := range usage.Classes {
+		byClass[c.Class] = c
+	}
+	if c := byClass["plans"]; c.Items != 3 || len(c.Expired) != 2 || c.Bytes == 0 {
+		t.Errorf("unexpected plans usage: %+v", c)
+	}
+	if c := byClass["threads"]; c.Items != 2 || len(c.Expired) != 1 || c.Expired[0].ID != "u-old" {
+		t.Errorf("pinned threads should be kept: %+v", c)
+	}
+	if c := byClass["idle_threads"]; len(c.Expired) != 1 {
+		t.Errorf("default idle rule should apply: %+v", c)
+	}
+	if _, err := loadThreadMeta("u-old"); err != nil {
+		t.Fatal("GET /api/storage must not remove anything")
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleStorage(w, httptest.NewRequest("POST", "/api/storage/gc", strings.NewReader(`{}`)))
+	var report RetentionReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if w.Code != 200 || report.DryRun {
+		t.Fatalf("gc failed: %d %s", w.Code, w.Body.String())
+	}
+	for _, id := range []string{"u-old", idleThreadIDPrefix + "2000-01-01"} {
+		if _, err := loadThreadMeta(id); err == nil {
+			t.Errorf("expected %s removed", id)
+		}
+	}
+	for _, id := range []string{"u-pinned", idleThreadIDPrefix + "today"} {
+		if _, err := loadThreadMeta(id); err != nil {
+			t.Errorf("expected %s kept", id)
+		}
+	}
+	// Archived threads keep their media; deleted ones don't
+	if _, err := os.Stat(filepath.Join(playgroundDir, "image_archived.png")); err != nil {
+		t.Error("expected media of an archived thread to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(playgroundDir, "image_idle.png")); !os.IsNotExist(err) {
+		t.Error("expected media of a deleted thread to be collected")
+	}
+	plans, _ := filepath.Glob(filepath.Join(planDir(), "*.json"))
+	if len(plans) != 1 || filepath.Base(plans[0]) != "c.json" {
+		t.Errorf("expected only the newest plan kept, got %v", plans)
+	}
+	var archive string
+	for _, c := range report.Classes {
+		if c.Class == "plans" {
+			archive = c.Archive
+		}
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatalf("expected plans archive: %v", err)
+	}
+	defer f.Close()
+	gz, _ := gzip.NewReader(f)
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a.json,b.json" {
+		t.Errorf("unexpected archive entries: %v", names)
+	}
+}
+
+func TestPlaybookManagement(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	origPlaybook := playbookDir
+	playbookDir = t.TempDir()
+	defer func() { playbookDir = origPlaybook }()
+
+	savePlaybook([]PlaybookBullet{
+		{ID: "b1", Type: "strategy", Content: "Check the weather before planning trips", Hits: 1},
+		{ID: "b2", Type: "pitfall", Content: "Train times change on holidays", Hits: 0, Misses: 3},
+		{ID: "b3", Type: "preference", Content: "User prefers short answers", Retired: true},
+	})
+
+	server := mockLLMServer(t, streamingLLMResponse([]string{"Take", " the train"}))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	// A chat turn records which bullets were injected
+	req := httptest.NewRequest("POST", "/api/chat/stream", strings.NewReader(`{"message":"how do I get to kyoto","conversation_id":"pb1"}`))
+	ws.handleChatStream(newFlushRecorder(), req)
+	msgs, _ := loadThreadMessages("pb1")
+	recorded := ""
+	for _, m := range msgs {
+		if m.EventType == "playbook" {
+			recorded = m.Content
+		}
+	}
+	if recorded != "b1,b2" {
+		t.Fatalf("expected active bullets recorded for the turn, got %q", recorded)
+	}
+	if ctx := buildPlaybookContext(); strings.Contains(ctx, "short answers") {
+		t.Errorf("retired bullets must not be injected: %s", ctx)
+	}
+
+	vote := func(body string) (int, PlaybookFeedbackResult) {
+		w := httptest.NewRecorder()
+		ws.handlePlaybook(w, httptest.NewRequest("POST", "/api/playbook/feedback", strings.NewReader(body)))
+		var res PlaybookFeedbackResult
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	code, res := vote(`{"thread_id":"pb1","vote":"up"}`)
+	if code != http.StatusOK || len(res.Bullets) != 2 || res.Bullets[0].Hits != 2 {
+		t.Fatalf("expected both bullets credited, got %d %+v", code, res)
+	}
+	// Changing the vote undoes the credit; b2 crosses the retire threshold
+	code, res = vote(fmt.Sprintf(`{"thread_id":"pb1","index":%d,"vote":"down"}`, res.Index))
+	if code != http.StatusOK || len(res.Retired) != 1 || res.Retired[0] != "b2" {
+		t.Fatalf("expected b2 auto-retired, got %d %+v", code, res)
+	}
+	bullets, _ := loadPlaybook()
+	if bullets[0].Hits != 1 || bullets[0].Misses != 1 || !bullets[1].Retired {
+		t.Errorf("unexpected scores after revote: %+v", bullets)
+	}
+	if code, _ := vote(`{"thread_id":"pb1","vote":"meh"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad vote, got %d", code)
+	}
+	if code, _ := vote(`{"thread_id":"nope","vote":"up"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing thread, got %d", code)
+	}
+
+	// List, search and filter
+	list := func(query string) []PlaybookBullet {
+		w := httptest.NewRecorder()
+		ws.handlePlaybook(w, httptest.NewRequest("GET", "/api/playbook"+query, nil))
+		var resp struct {
+			Bullets []PlaybookBullet `json:"bullets"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Bullets
+	}
+	if got := list(""); len(got) != 3 {
+		t.Errorf("expected all bullets, got %d", len(got))
+	}
+	if got := list("?status=active"); len(got) != 1 || got[0].ID != "b1" {
+		t.Errorf("expected only b1 active, got %+v", got)
+	}
+	if got := list("?q=TRAIN+holidays"); len(got) != 1 || got[0].ID != "b2" {
+		t.Errorf("expected search to find b2, got %+v", got)
+	}
+
+	// Add, edit, pin, restore and delete
+	w := httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("POST", "/api/playbook", strings.NewReader(`{"type":"preference","content":"Answer in Japanese"}`)))
+	var added PlaybookBullet
+	json.Unmarshal(w.Body.Bytes(), &added)
+	if w.Code != http.StatusCreated || added.ID == "" {
+		t.Fatalf("expected bullet created, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("PATCH", "/api/playbook/b2", strings.NewReader(`{"content":"Check holiday timetables","pinned":true,"retired":false}`)))
+	var edited PlaybookBullet
+	json.Unmarshal(w.Body.Bytes(), &edited)
+	if w.Code != http.StatusOK || !edited.Pinned || edited.Retired || edited.Content != "Check holiday timetables" {
+		t.Errorf("unexpected patch result %d: %+v", w.Code, edited)
+	}
+	w = httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("PATCH", "/api/playbook/b2", strings.NewReader(`{"type":"bogus"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown type, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("DELETE", "/api/playbook/b3", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected delete ok, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("GET", "/api/playbook/b3", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", w.Code)
+	}
+	if ctx := buildPlaybookContext(); !strings.HasPrefix(strings.SplitN(ctx, "\n- ", 2)[1], "[注意点] Check holiday") {
+		t.Errorf("expected pinned bullet first: %s", ctx)
+	}
+
+	// Pinned bullets survive negative feedback
+	vote(`{"thread_id":"pb1","vote":"up"}`)
+	vote(`{"thread_id":"pb1","vote":"down"}`)
+	if b, _ := loadPlaybook(); b[1].Retired {
+		t.Errorf("pinned bullet must not be retired: %+v", b[1])
+	}
+
+	// A rating reset to 0 takes the turn's vote back
+	misses := func() int {
+		b, _ := loadPlaybook()
+		for _, bullet := range b {
+			if bullet.ID == "b1" {
+				return bullet.Misses
+			}
+		}
+		return -1
+	}
+	before := misses()
+	w = httptest.NewRecorder()
+	ws.handleFeedback(w, httptest.NewRequest("POST", "/api/feedback", strings.NewReader(`{"thread_id":"pb1","rating":0}`)))
+	if w.Code != http.StatusOK || misses() != before-1 {
+		t.Errorf("expected the down vote retracted (%d -> %d): %d %s", before, misses(), w.Code, w.Body.String())
+	}
+	vote(`{"thread_id":"pb1","vote":"clear"}`)
+	if misses() != before-1 {
+		t.Errorf("clearing twice must not change scores again, got %d", misses())
+	}
+
+	// Every decision is in the curation log
+	w = httptest.NewRecorder()
+	ws.handlePlaybook(w, httptest.NewRequest("GET", "/api/playbook/log", nil))
+	var entries []PlaybookCuration
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	actions := make(map[string]bool)
+	for _, e := range entries {
+		actions[e.Action] = true
+	}
+	for _, a := range []string{"vote_up", "vote_down", "vote_clear", "retire", "add", "edit", "pin", "restore", "delete"} {
+		if !actions[a] {
+			t.Errorf("expected %s in curation log, got %+v", a, entries)
+		}
+	}
+}
+
+func TestCurateBullets_RetireAndEvict(t *testing.T) {
+	var existing []PlaybookBullet
+	for i := 0; i < 100; i++ {
+		existing = append(existing, PlaybookBullet{ID: fmt.Sprintf("s%d", i), Type: "strategy", Content: fmt.Sprintf("unique%d", i), Hits: i})
+	}
+	existing = append(existing,
+		PlaybookBullet{ID: "bad", Content: "always retry forever", Misses: 4, Retired: true},
+		PlaybookBullet{ID: "shaky", Content: "guess the file path", Hits: 1, Misses: 4},
+		PlaybookBullet{ID: "pin", Content: "pinned rule", Pinned: true, Misses: 9},
+	)
+	merged, log := curateBullets(existing, []PlaybookBullet{
+		{ID: "new", Content: "brand new insight", Hits: 5},
+		{ID: "dup", Content: "always retry forever", Hits: 1},
+	})
+
+	byID := make(map[string]PlaybookBullet)
+	for _, b := range merged {
+		byID[b.ID] = b
+	}
+	if byID["bad"].Hits != 0 {
+		t.Errorf("retired bullet must not be relearned: %+v", byID["bad"])
+	}
+	if !byID["shaky"].Retired {
+		t.Errorf("expected unreliable bullet retired: %+v", byID["shaky"])
+	}
+	if byID["pin"].Retired {
+		t.Error("pinned bullet must not be retired")
+	}
+	if _, ok := byID["s0"]; ok {
+		t.Error("expected lowest scoring bullet evicted over capacity")
+	}
+	if _, ok := byID["new"]; !ok {
+		t.Error("expected new bullet kept")
+	}
+	actions := make(map[string]int)
+	for _, e := range log {
+		actions[e.Action]++
+	}
+	// The pinned bullet counts toward the cap of 100: s0 and s1 go
+	if actions["add"] != 1 || actions["reject"] != 1 || actions["retire"] != 1 || actions["evict"] != 2 {
+		t.Errorf("unexpected curation log: %+v", log)
+	}
+}
+
+func TestMessageFeedback(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	origPlaybook := playbookDir
+	playbookDir = t.TempDir()
+	defer func() { playbookDir = origPlaybook }()
+	ws := &WebServer{config: &Config{}, conversations: make(map[string]*Agent)}
+
+	now := time.Now()
+	saveThreadMeta(&Thread{ID: "fb1", Title: "Weather", CreatedAt: now, UpdatedAt: now})
+	for _, m := range []ThreadMessage{
+		{Role: "user", Content: "weather in tokyo?"},
+		{EventType: "route", Role: "assistant", Content: "dual", Model: "main-model"},
+		{EventType: "thinking", Role: "assistant", Content: "need the forecast", Model: "sub-model"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "c1", Type: "function", Function: ToolCallFunc{Name: "web_search", Arguments: `{"q":"tokyo"}`}}}},
+		{Role: "tool", Content: "sunny 20C", ToolCallID: "c1", ToolName: "web_search"},
+		{Role: "assistant", Content: "It is sunny."},
+		{Role: "user", Content: "thanks"},
+		{Role: "assistant", Content: "You're welcome."},
+	} {
+		appendToLog("fb1", m)
+	}
+
+	post := func(body string) (int, MessageFeedback) {
+		w := httptest.NewRecorder()
+		ws.handleFeedback(w, httptest.NewRequest("POST", "/api/feedback", strings.NewReader(body)))
+		var resp struct {
+			Feedback MessageFeedback `json:"feedback"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Feedback
+	}
+	code, fb := post(`{"thread_id":"fb1","index":5,"rating":-1,"tags":["Wrong-Unit"]}`)
+	if code != http.StatusOK || fb.Route != "dual" || len(fb.Tools) != 1 || fb.Tools[0] != "web_search" {
+		t.Fatalf("expected turn details, got %d %+v", code, fb)
+	}
+	if len(fb.Models) != 2 || fb.Tags[0] != "wrong-unit" {
+		t.Errorf("expected models and normalized tags, got %+v", fb)
+	}
+	// Omitted fields keep their values
+	if _, fb = post(`{"thread_id":"fb1","index":5,"correction":"It is sunny, 20°C."}`); fb.Rating != -1 || len(fb.Tags) != 1 {
+		t.Errorf("expected merge with earlier feedback, got %+v", fb)
+	}
+	// No index rates the latest reply
+	if _, fb = post(`{"thread_id":"fb1","rating":1}`); fb.Index != 7 || fb.Route != "" {
+		t.Errorf("expected latest reply rated, got %+v", fb)
+	}
+	if code, _ := post(`{"thread_id":"fb1","index":4,"rating":1}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a tool message, got %d", code)
+	}
+	if code, _ := post(`{"thread_id":"fb1","index":5,"rating":3}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad rating, got %d", code)
+	}
+	if code, _ := post(`{"thread_id":"missing","rating":1}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing thread, got %d", code)
+	}
+
+	// Feedback lives in the thread log
+	msgs, _ := loadThreadMessages("fb1")
+	if items := threadFeedback("fb1", msgs); len(items) != 2 || items[0].Correction == "" {
+		t.Errorf("expected latest feedback per message, got %+v", items)
+	}
+
+	w := httptest.NewRecorder()
+	ws.handleFeedback(w, httptest.NewRequest("GET", "/api/feedback?rating=down", nil))
+	var listed []MessageFeedback
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].Index != 5 {
+		t.Errorf("expected one down-rated message, got %+v", listed)
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleFeedback(w, httptest.NewRequest("GET", "/api/feedback/stats", nil))
+	var st FeedbackStats
+	json.Unmarshal(w.Body.Bytes(), &st)
+	if st.Total != 2 || st.Up != 1 || st.Down != 1 || st.Corrected != 1 {
+		t.Errorf("unexpected totals: %+v", st.FeedbackCount)
+	}
+	if st.ByTool["web_search"].Down != 1 || st.ByTool["none"].Up != 1 || st.ByRoute["dual"].Total != 1 || st.ByModel["sub-model"].Down != 1 || st.ByTag["wrong-unit"].Total != 1 {
+		t.Errorf("unexpected breakdown: %s", w.Body.String())
+	}
+
+	export := func(query string) []map[string]interface{} {
+		w := httptest.NewRecorder()
+		ws.handleFeedback(w, httptest.NewRequest("GET", "/api/feedback/export"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("export %s: %d %s", query, w.Code, w.Body.String())
+		}
+		var out []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var rec map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("bad jsonl line %q: %v", line, err)
+			}
+			out = append(out, rec)
+		}
+		return out
+	}
+	recs := export("?rating=corrected")
+	if len(recs) != 1 {
+		t.Fatalf("expected one corrected example, got %d", len(recs))
+	}
+	messages := recs[0]["messages"].([]interface{})
+	last := messages[len(messages)-1].(map[string]interface{})
+	if len(messages) != 2 || last["content"] != "It is sunny, 20°C." || last["reasoning_content"] != nil {
+		t.Errorf("expected user + corrected reply without traces, got %+v", messages)
+	}
+	if recs[0]["metadata"].(map[string]interface{})["original"] != "It is sunny." {
+		t.Errorf("expected original reply in metadata: %+v", recs[0]["metadata"])
+	}
+
+	recs = export("?format=sharegpt&rating=down&tools=1&thinking=1")
+	convs := recs[0]["conversations"].([]interface{})
+	var from []string
+	for _, c := range convs {
+		from = append(from, c.(map[string]interface{})["from"].(string))
+	}
+	if strings.Join(from, ",") != "human,function_call,observation,gpt" {
+		t.Errorf("unexpected sharegpt turns: %v", from)
+	}
+	if v := convs[3].(map[string]interface{})["value"].(string); !strings.HasPrefix(v, "<think>\nneed the forecast") {
+		t.Errorf("expected reasoning in gpt turn: %q", v)
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleFeedback(w, httptest.NewRequest("GET", "/api/feedback/export?format=csv", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown format, got %d", w.Code)
+	}
+
+	// Earlier turns lead the example after the rolling summary; replies that
+	// also called tools keep their text without traces
+	saveThreadMeta(&Thread{ID: "fb2", Title: "Trip", CreatedAt: now, UpdatedAt: now, Summary: "User is planning a trip.", SummaryIndex: 1})
+	for _, m := range []ThreadMessage{
+		{Role: "user", Content: "plan a trip"},
+		{Role: "assistant", Content: "Where to?"},
+		{Role: "user", Content: "kyoto"},
+		{Role: "assistant", Content: "Let me check.", ToolCalls: []ToolCall{{ID: "c2", Type: "function", Function: ToolCallFunc{Name: "web_search", Arguments: `{"q":"kyoto"}`}}}},
+		{Role: "tool", Content: "leaves turn in november", ToolCallID: "c2", ToolName: "web_search"},
+		{Role: "assistant", Content: "Go in autumn."},
+	} {
+		appendToLog("fb2", m)
+	}
+	post(`{"thread_id":"fb2","rating":1}`)
+	recs = export("?thread_id=fb2")
+	messages = recs[0]["messages"].([]interface{})
+	var got []string
+	for _, m := range messages {
+		mm := m.(map[string]interface{})
+		if mm["tool_calls"] != nil {
+			t.Errorf("expected no tool_calls without traces: %+v", mm)
+		}
+		got = append(got, mm["role"].(string)+":"+mm["content"].(string))
+	}
+	want := "system:Summary of the earlier conversation:\nUser is planning a trip.|assistant:Where to?|user:kyoto|assistant:Let me check.|assistant:Go in autumn."
+	if strings.Join(got, "|") != want {
+		t.Errorf("unexpected example:\n got %s\nwant %s", strings.Join(got, "|"), want)
+	}
+
+	// A dual-pipeline reply is credited to the model that wrote it
+	for _, m := range []ThreadMessage{
+		{Role: "user", Content: "news?"},
+		{EventType: "route", Role: "assistant", Content: "dual", Model: "main-model"},
+		{EventType: "thinking", Role: "assistant", Content: "searching", Model: "sub-model"},
+		{Role: "assistant", Content: "Here is the news.", Model: "summary-model"},
+	} {
+		appendToLog("fb3", m)
+	}
+	saveThreadMeta(&Thread{ID: "idle-chat", Title: "No ratings", CreatedAt: now, UpdatedAt: now})
+	appendToLog("idle-chat", ThreadMessage{Role: "user", Content: "hi"})
+	if _, fb = post(`{"thread_id":"fb3","rating":-1}`); len(fb.Models) != 1 || fb.Models[0] != "summary-model" {
+		t.Errorf("expected the reply's own model, got %+v", fb.Models)
+	}
+
+	// Only threads with feedback are indexed, and a lost index is rebuilt
+	if ids := strings.Join(feedbackThreadIDs(), ","); ids != "fb1,fb2,fb3" {
+		t.Errorf("unexpected feedback index: %s", ids)
+	}
+	os.Remove(feedbackIndexPath())
+	feedbackThreads = nil
+	deleteThread("fb2")
+	if ids := strings.Join(feedbackThreadIDs(), ","); ids != "fb1,fb3" {
+		t.Errorf("unexpected rebuilt index: %s", ids)
+	}
+}
+
+func TestThreadRollingSummary(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	var mu sync.Mutex
+	var prompts []string
+	server := mockLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		prompts = append(prompts, req.Messages[len(req.Messages)-1].Content)
+		n := len(prompts)
+		mu.Unlock()
+		staticLLMResponse(fmt.Sprintf("SUMMARY-%d", n))(w, r)
+	})
 	defer server.Close()
 	cfg := testConfig(server.URL)
+
+	now := time.Now()
+	saveThreadMeta(&Thread{ID: "long", Title: "Long", CreatedAt: now, UpdatedAt: now})
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			role := "user"
+			if i%2 == 1 {
+				role = "assistant"
+			}
+			appendToLog("long", ThreadMessage{Role: role, Content: fmt.Sprintf("msg-%03d", i)})
+			if i%10 == 0 {
+				appendToLog("long", ThreadMessage{EventType: "thinking", Role: "assistant", Content: "hmm"})
+			}
+		}
+	}
+	add(0, 80)
+
+	meta, err := updateThreadSummary(context.Background(), cfg, cfg.primaryProvider().Model, "long", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, _ := loadThreadMessages("long")
+	if meta.Summary != "SUMMARY-1" || msgs[meta.SummaryIndex].Content != "msg-020" {
+		t.Fatalf("expected summary up to msg-020, got %q at %d", meta.Summary, meta.SummaryIndex)
+	}
+	if !strings.Contains(prompts[0], "msg-019") || strings.Contains(prompts[0], "msg-020") {
+		t.Errorf("expected only messages before the boundary, got %q", prompts[0])
+	}
+	// Nothing new past the boundary: no model call
+	if _, err := updateThreadSummary(context.Background(), cfg, cfg.primaryProvider().Model, "long", 60); err != nil || len(prompts) != 1 {
+		t.Errorf("expected no resummarization, got %d calls (%v)", len(prompts), err)
+	}
+
+	// Incremental: only new messages plus the previous summary are sent
+	add(80, 100)
+	meta, _ = updateThreadSummary(context.Background(), cfg, cfg.primaryProvider().Model, "long", 60)
+	if meta.Summary != "SUMMARY-2" || len(prompts) != 2 {
+		t.Fatalf("expected rolled summary, got %q", meta.Summary)
+	}
+	if !strings.Contains(prompts[1], "SUMMARY-1") || strings.Contains(prompts[1], "msg-019") || !strings.Contains(prompts[1], "msg-039") {
+		t.Errorf("expected incremental prompt, got %q", prompts[1])
+	}
+
+	// Exposed in the thread list
 	ws := NewWebServer(cfg)
+	w := httptest.NewRecorder()
+	ws.handleThreads(w, httptest.NewRequest("GET", "/api/threads", nil))
+	if !strings.Contains(w.Body.String(), `"summary":"SUMMARY-2"`) || !strings.Contains(w.Body.String(), fmt.Sprintf(`"summary_index":%d`, meta.SummaryIndex)) {
+		t.Errorf("expected summary in thread list: %s", w.Body.String())
+	}
+
+	// A rebuilt agent reuses the summary instead of digesting covered messages
+	agent := ws.getOrCreateAgent("long")
+	var ctxText strings.Builder
+	for _, m := range agent.messages[1:] {
+		ctxText.WriteString(m.Content + "\n")
+	}
+	if !strings.Contains(ctxText.String(), "[以前の会話の要約]\nSUMMARY-2") {
+		t.Errorf("expected persisted summary in agent context")
+	}
+	if strings.Contains(ctxText.String(), "msg-039") || !strings.Contains(ctxText.String(), "msg-040") {
+		t.Errorf("expected covered messages dropped and the rest kept: %s", ctxText.String())
+	}
+
+	// Compression rolls the same summary forward and cuts memory where it
+	// ends in the log, keeping messages that were never logged
+	add(100, 110)
+	for i := 100; i < 110; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		agent.messages = append(agent.messages, Message{Role: role, Content: fmt.Sprintf("msg-%03d", i)})
+		if i == 104 {
+			agent.messages = append(agent.messages, Message{Role: "tool", Content: "Error: bad arguments", ToolCallID: "unlogged"})
+		}
+	}
+	agent.compressConversation(context.Background())
+	meta, _ = loadThreadMeta("long")
+	if meta.Summary != "SUMMARY-3" || agent.messages[1].Content != "[以前の会話の要約]\nSUMMARY-3" {
+		t.Fatalf("expected compression to use the rolled summary, got %q / %q", meta.Summary, agent.messages[1].Content)
+	}
+	msgs, _ = loadThreadMessages("long")
+	if agent.messages[2].Content != msgs[meta.SummaryIndex].Content || len(agent.messages) != 2+60+1 {
+		t.Errorf("expected memory to resume at %q, got %q (%d messages)", msgs[meta.SummaryIndex].Content, agent.messages[2].Content, len(agent.messages))
+	}
+}
+
+func TestToolResultMessage_SmallResultInline(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	msg := toolResultMessage("short result", "tc1", "grep")
+	if msg.Content != "short result" || msg.ArtifactID != "" || msg.Role != "tool" || msg.ToolCallID != "tc1" {
+		t.Errorf("small results should stay inline: %+v", msg)
+	}
+}
+
+func TestToolResultMessage_LargeResultStoredAsArtifact(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "line %d of the page\n", i)
+	}
+	full := sb.String()
+	msg := toolResultMessage(full, "tc2", "web_fetch")
+	if msg.ArtifactID == "" {
+		t.Fatal("expected large result to be stored as an artifact")
+	}
+	if msg.ArtifactID != artifactIDFor(full) {
+		t.Error("artifact ID should be content-addressed")
+	}
+	if len(msg.Content) >= len(full) || !strings.Contains(msg.Content, "[artifact:"+msg.ArtifactID) {
+		t.Errorf("expected preview with artifact reference, got %d bytes", len(msg.Content))
+	}
+	if !strings.HasPrefix(msg.Content, "line 0 of the page") || !strings.Contains(msg.Content, "line 1999 of the page") {
+		t.Error("preview should include head and tail")
+	}
+
+	content, meta, err := loadArtifact(msg.ArtifactID)
+	if err != nil || content != full {
+		t.Fatalf("artifact should hold the full result: %v", err)
+	}
+	if meta.Tool != "web_fetch" || meta.Size != len(full) {
+		t.Errorf("unexpected artifact metadata: %+v", meta)
+	}
+
+	// Linked from the thread log
+	appendMessageToThread("art-thread", msg, "web_fetch")
+	msgs, _ := loadThreadMessages("art-thread")
+	if len(msgs) != 1 || msgs[0].ArtifactID != msg.ArtifactID {
+		t.Errorf("expected ThreadMessage to link the artifact, got %+v", msgs)
+	}
+}
+
+func TestReadArtifact_PagingAndGrep(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	id, err := saveArtifact("alpha\nbeta\ngamma\nBETA two\ndelta", "grep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &Agent{config: &Config{}}
+
+	out, err := agent.executeTool("read_artifact", map[string]interface{}{"id": id, "offset": "1", "limit": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "2: beta") || !strings.Contains(out, "3: gamma") || strings.Contains(out, "4: BETA") {
+		t.Errorf("unexpected page: %s", out)
+	}
+	if !strings.Contains(out, "offset=3") {
+		t.Errorf("expected continuation hint, got: %s", out)
+	}
+
+	out, _ = readArtifact(id, 0, 0, "beta")
+	if !strings.Contains(out, "2: beta") || !strings.Contains(out, "4: BETA two") || !strings.Contains(out, "2 of 2") {
+		t.Errorf("unexpected grep output: %s", out)
+	}
+
+	if _, err := readArtifact("../../etc/passwd", 0, 0, ""); err == nil {
+		t.Error("expected invalid artifact id to be rejected")
+	}
+}
+
+func TestHandleArtifacts(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	id, _ := saveArtifact("artifact body", "docker_exec")
+	ws := NewWebServer(&Config{})
+
+	w := httptest.NewRecorder()
+	ws.handleArtifacts(w, httptest.NewRequest("GET", "/api/artifacts/"+id, nil))
+	if w.Code != 200 || w.Body.String() != "artifact body" {
+		t.Errorf("expected artifact content, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleArtifacts(w, httptest.NewRequest("GET", "/api/artifacts/"+id+"?meta=1", nil))
+	var meta Artifact
+	json.NewDecoder(w.Body).Decode(&meta)
+	if meta.ID != id || meta.Tool != "docker_exec" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	w = httptest.NewRecorder()
+	ws.handleArtifacts(w, httptest.NewRequest("GET", "/api/artifacts/0000000000000000", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing artifact, got %d", w.Code)
+	}
+}
+
+func TestRecordMediaOutputs(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	os.WriteFile(filepath.Join(playgroundDir, "image_1.png"), []byte("png"), 0644)
+	saveThreadMeta(&Thread{ID: "t1", Title: "media", MessageCount: 3, CreatedAt: time.Now(), UpdatedAt: time.Now()})
+
+	agent := &Agent{config: &Config{ImageModel: "flux-test"}, threadID: "t1"}
+	agent.recordMediaOutputs("generate_image", map[string]interface{}{
+		"prompt": "a red fox", "width": float64(512), "seed": float64(42),
+	}, "Image generated: /playground/image_1.png")
+	// Re-registering the same file is a no-op
+	agent.recordMediaOutputs("generate_image", map[string]interface{}{"prompt": "again"}, "/playground/image_1.png")
+
+	items, err := listMedia(MediaFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected 1 media item, got %d", len(items))
+	}
+	item := items[0]
+	if item.Type != "image" || item.Prompt != "a red fox" || item.Model != "flux-test" {
+		t.Errorf("unexpected item: %+v", item)
+	}
+	if item.ThreadID != "t1" || item.MessageIndex != 3 || item.Params["seed"] != float64(42) {
+		t.Errorf("expected thread/index/params to be recorded, got %+v", item)
+	}
+}
+
+func TestSyncMediaRegistry_Backfill(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	os.WriteFile(filepath.Join(playgroundDir, "diagram_1.html"), []byte("<html>"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "video_1.mp4"), []byte("mp4"), 0644)
+
+	items, err := listMedia(MediaFilter{Type: "diagram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].File != "diagram_1.html" {
+		t.Errorf("expected backfilled diagram, got %+v", items)
+	}
+
+	os.Remove(filepath.Join(playgroundDir, "video_1.mp4"))
+	all, _ := listMedia(MediaFilter{})
+	if len(all) != 1 {
+		t.Errorf("expected item with missing file to be dropped, got %d", len(all))
+	}
+
+	// Image server outputs and rendered diagrams are registered in place
+	os.MkdirAll(imageOutputDir(), 0755)
+	os.WriteFile(filepath.Join(imageOutputDir(), "out_1.png"), []byte("png"), 0644)
+	os.WriteFile(filepath.Join(diagramDir, "flow.svg"), []byte("<svg/>"), 0644)
+	images, _ := listMedia(MediaFilter{Type: "image"})
+	if len(images) != 1 || images[0].File != "out_1.png" || images[0].Root != "images" || images[0].Tool != "generate_image" {
+		t.Fatalf("expected registered image output, got %+v", images)
+	}
+	if _, err := os.Stat(filepath.Join(imageOutputDir(), "out_1.png")); err != nil {
+		t.Error("image output should stay in the image server directory")
+	}
+	if images[0].URL != "/api/media/"+images[0].ID+"/file" {
+		t.Errorf("unexpected image output URL %s", images[0].URL)
+	}
+	diagrams, _ := listMedia(MediaFilter{Type: "diagram"})
+	if len(diagrams) != 2 {
+		t.Fatalf("expected playground and rendered diagrams, got %+v", diagrams)
+	}
+	for _, d := range diagrams {
+		if d.File == "flow.svg" && (d.Root != "diagrams" || d.URL != "/diagrams/flow.svg") {
+			t.Errorf("unexpected diagram item %+v", d)
+		}
+	}
+
+	ws := NewWebServer(&Config{})
+	w := httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("GET", images[0].URL, nil))
+	if w.Code != 200 || w.Body.String() != "png" {
+		t.Errorf("expected image output served, got %d %q", w.Code, w.Body.String())
+	}
+	if n, _ := deleteMedia([]string{images[0].ID}); n != 1 {
+		t.Fatal("expected image output deleted")
+	}
+	if _, err := os.Stat(filepath.Join(imageOutputDir(), "out_1.png")); !os.IsNotExist(err) {
+		t.Error("expected deleting the item to remove the file where it lives")
+	}
+}
+
+func TestGCMediaForThread(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	now := time.Now()
+	saveThreadMeta(&Thread{ID: "gc1", Title: "gc", CreatedAt: now, UpdatedAt: now})
+	os.WriteFile(filepath.Join(playgroundDir, "image_a.png"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "image_b.png"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "image_c.png"), []byte("c"), 0644)
+	registerMedia(MediaItem{File: "image_a.png", ThreadID: "gc1"})
+	kept, _ := registerMedia(MediaItem{File: "image_b.png", ThreadID: "gc1"})
+	registerMedia(MediaItem{File: "image_c.png", ThreadID: "other"})
+	tagMedia(kept.ID, []string{"keep"}, nil)
+
+	if err := deleteThread("gc1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(playgroundDir, "image_a.png")); !os.IsNotExist(err) {
+		t.Error("expected untagged media of deleted thread to be removed")
+	}
+	for _, f := range []string{"image_b.png", "image_c.png"} {
+		if _, err := os.Stat(filepath.Join(playgroundDir, f)); err != nil {
+			t.Errorf("expected %s to be kept", f)
+		}
+	}
+
+	// Media a branch still links to moves to the branch with the parent's deletion
+	saveThreadMeta(&Thread{ID: "gc2", Title: "parent", CreatedAt: now, UpdatedAt: now})
+	appendToLog("gc2", ThreadMessage{Role: "user", Content: "draw"})
+	appendToLog("gc2", ThreadMessage{Role: "assistant", Content: "![d](/playground/image_d.png)"})
+	appendToLog("gc2", ThreadMessage{Role: "user", Content: "again"})
+	appendToLog("gc2", ThreadMessage{Role: "assistant", Content: "![e](/playground/image_e.png)"})
+	for _, f := range []string{"image_d.png", "image_e.png"} {
+		os.WriteFile(filepath.Join(playgroundDir, f), []byte(f), 0644)
+		registerMedia(MediaItem{File: f, ThreadID: "gc2"})
+	}
+	branch, _, err := forkThread("gc2", 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteThread("gc2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(playgroundDir, "image_e.png")); !os.IsNotExist(err) {
+		t.Error("expected media only the parent linked to be removed")
+	}
+	items, _ := listMedia(MediaFilter{})
+	adopted := false
+	for _, item := range items {
+		if item.File == "image_d.png" {
+			adopted = item.ThreadID == branch.ID
+		}
+	}
+	if !adopted {
+		t.Errorf("expected image_d.png to belong to branch %s, got %+v", branch.ID, items)
+	}
+}
+
+func TestHandleMedia(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	os.WriteFile(filepath.Join(playgroundDir, "image_1.png"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(playgroundDir, "image_2.png"), []byte("two"), 0644)
+	first, _ := registerMedia(MediaItem{File: "image_1.png", Prompt: "sunset over sea"})
+	second, _ := registerMedia(MediaItem{File: "image_2.png", Prompt: "mountain"})
+	ws := NewWebServer(&Config{})
+
+	// Tag and filter
+	w := httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("POST", "/api/media/"+first.ID+"/tags", strings.NewReader(`{"add":["fav"]}`)))
+	if w.Code != 200 {
+		t.Fatalf("tag failed: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("GET", "/api/media?tag=fav", nil))
+	var list struct {
+		Media []MediaItem `json:"media"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Media) != 1 || list.Media[0].ID != first.ID {
+		t.Errorf("expected tag filter to return first item, got %+v", list.Media)
+	}
+	w = httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("GET", "/api/media?q=mountain", nil))
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list.Media) != 1 || list.Media[0].ID != second.ID {
+		t.Errorf("expected query filter to return second item, got %+v", list.Media)
+	}
+
+	// Zip export
+	w = httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("POST", "/api/media/export", strings.NewReader(`{"ids":["`+first.ID+`","`+second.ID+`"]}`)))
+	if w.Code != 200 {
+		t.Fatalf("export failed: %d %s", w.Code, w.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[f.Name] = true
+	}
+	if !names["image_1.png"] || !names["image_2.png"] || !names["manifest.json"] {
+		t.Errorf("unexpected zip contents: %v", names)
+	}
+
+	// Delete
+	w = httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("DELETE", "/api/media/"+second.ID, nil))
+	if w.Code != 200 {
+		t.Errorf("delete failed: %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(playgroundDir, "image_2.png")); !os.IsNotExist(err) {
+		t.Error("expected file to be deleted")
+	}
+	w = httptest.NewRecorder()
+	ws.handleMedia(w, httptest.NewRequest("DELETE", "/api/media/"+second.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for deleted item, got %d", w.Code)
+	}
+}
+
+// ============================================================================
+// 7. Plugin System Tests
+// ============================================================================
+
+func TestSaveAndLoadPlugins(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	plugin := Plugin{
+		Name:        "test-plugin",
+		Description: "A test plugin",
+		Version:     "1.0",
+		Tested:      true,
+		Tool: &PluginTool{
+			Description: "Does things",
+			Parameters:  map[string]interface{}{"type": "object"},
+			Code:        "console.log('hello');",
+		},
+	}
+	if err := savePlugin(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedPlugins) != 1 {
+		t.Fatalf("expected 1 plugin, got %d", len(loadedPlugins))
+	}
+	if loadedPlugins[0].Name != "test-plugin" || loadedPlugins[0].Tool == nil {
+		t.Errorf("unexpected plugin: %+v", loadedPlugins[0])
+	}
+}
+
+func TestDeletePluginFile(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	savePlugin(Plugin{Name: "doomed", Description: "will die", Version: "1.0"})
+	if err := deletePluginFile("doomed"); err != nil {
+		t.Fatal(err)
+	}
+	loadPlugins()
+	if len(loadedPlugins) != 0 {
+		t.Errorf("expected 0 plugins after delete, got %d", len(loadedPlugins))
+	}
+}
+
+func TestGetAllTools_WithPlugin(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	// Load a plugin with a tool
+	loadedPlugins = []Plugin{
+		{
+			Name:    "myplugin",
+			Version: "1.0",
+			Tested:  true,
+			Tool: &PluginTool{
+				Description: "My tool",
+				Parameters:  map[string]interface{}{"type": "object"},
+				Code:        "console.log('test');",
+			},
+		},
+	}
+
+	allTools := getAllTools()
+	found := false
+	for _, tool := range allTools {
+		if tool.Name == "plugin_myplugin" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("expected plugin_myplugin in all tools")
+	}
+}
+
+func TestGetAllTools_SkipsDisabledPlugin(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	disabled := false
+	loadedPlugins = []Plugin{
+		{
+			Name:    "disabled-plugin",
+			Version: "1.0",
+			Enabled: &disabled,
+			Tested:  true,
+			Tool: &PluginTool{
+				Description: "Disabled tool",
+				Parameters:  map[string]interface{}{"type": "object"},
+				Code:        "console.log('nope');",
+			},
+		},
+	}
+
+	allTools := getAllTools()
+	for _, tool := range allTools {
+		if tool.Name == "plugin_disabled-plugin" {
+			t.Error("disabled plugin should not appear in tools")
+		}
+	}
+}
+
+func TestResolvePluginInterpreter(t *testing.T) {
+	if _, err := resolvePluginInterpreter(nil, "ruby"); err == nil {
+		t.Error("expected unknown runtime to be rejected")
+	}
+	if path, err := resolvePluginInterpreter(nil, "exec"); err != nil || path != "" {
+		t.Errorf("exec runtime needs no interpreter, got %q %v", path, err)
+	}
+	cfg := &Config{PluginRuntimes: map[string]string{"python": "/nonexistent/python3"}}
+	if _, err := resolvePluginInterpreter(cfg, "python"); err == nil {
+		t.Error("expected missing configured interpreter to fail")
+	}
+	sh, _ := exec.LookPath("sh")
+	cfg = &Config{PluginRuntimes: map[string]string{"node": sh}}
+	if path, err := resolvePluginInterpreter(cfg, "node"); err != nil || path != sh {
+		t.Errorf("expected configured interpreter %q, got %q %v", sh, path, err)
+	}
+}
+
+func TestExecutePluginTool_NodeStdinParams(t *testing.T) {
+	skipIfNoNode(t)
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	loadedPlugins = []Plugin{{
+		Name: "adder",
+		Tool: &PluginTool{Code: "console.error('adding'); console.log(params.x + params.y);"},
+	}}
+	out, err := executePluginTool(&Config{}, "adder", map[string]interface{}{"x": 2, "y": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "5" {
+		t.Errorf("expected stdout only (logs on stderr), got %q", out)
+	}
+}
+
+func TestRunPlugin_ToolCodeReadsStdin(t *testing.T) {
+	skipIfNoNode(t)
+	p := Plugin{Name: "own", Tool: &PluginTool{
+		Code: "const params = JSON.parse(require('fs').readFileSync(0, 'utf8'));\nconsole.log(params.word + globalThis.params.word);",
+	}}
+	res, err := runPlugin(&Config{}, p, map[string]interface{}{"word": "ab"})
+	if err != nil {
+		t.Fatalf("%v (logs: %s)", err, res.Logs)
+	}
+	if res.Output != "abab" {
+		t.Errorf("expected stdin and injected params to agree, got %q", res.Output)
+	}
+
+	if _, err := exec.LookPath("python3"); err != nil {
+		return
+	}
+	p = Plugin{Name: "ownpy", Runtime: "python", Tool: &PluginTool{
+		Code: "import json, sys\nprint(json.load(sys.stdin)['word'] + params['word'])",
+	}}
+	res, err = runPlugin(&Config{}, p, map[string]interface{}{"word": "cd"})
+	if err != nil {
+		t.Fatalf("%v (logs: %s)", err, res.Logs)
+	}
+	if res.Output != "cdcd" {
+		t.Errorf("expected stdin and injected params to agree, got %q", res.Output)
+	}
+}
+
+func TestRunPlugin_PythonStructuredOutput(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available, skipping")
+	}
+	p := Plugin{Name: "py", Runtime: "python", Tool: &PluginTool{
+		Code: "import json, sys\nprint(json.dumps({'result': {'upper': params['text'].upper()}}))\nprint('log line', file=sys.stderr)",
+	}}
+	res, err := runPlugin(&Config{}, p, map[string]interface{}{"text": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Output != `{"upper":"HI"}` || res.Logs != "log line" {
+		t.Errorf("unexpected result: %+v", res)
+	}
+
+	p.Tool.Code = "import json\nprint(json.dumps({'error': 'bad input'}))"
+	if _, err := runPlugin(&Config{}, p, nil); err == nil || !strings.Contains(err.Error(), "bad input") {
+		t.Errorf("expected structured error, got %v", err)
+	}
+}
+
+func TestPlanPluginSandbox_ReportsGrantsAndGaps(t *testing.T) {
+	p := Plugin{Name: "net", Permissions: &PluginPermissions{
+		Network: []string{"api.example.com"},
+		Read:    []string{"~/data"},
+		Env:     []string{"EXAMPLE_KEY"},
+	}}
+	plan := planPluginSandbox(p, pluginRuntimeNode)
+	desc := plan.describe()
+	for _, want := range []string{"network: api.example.com", "read: ~/data", "write: none", "env: EXAMPLE_KEY", "host allowlist not enforced"} {
+		if !strings.Contains(desc, want) {
+			t.Errorf("expected %q in %q", want, desc)
+		}
+	}
+
+	// Deno enforces the allowlist and path grants itself
+	plan = planPluginSandbox(p, pluginRuntimeDeno)
+	if desc := plan.describe(); strings.Contains(desc, "allowlist not enforced") || strings.Contains(desc, "advisory") {
+		t.Errorf("expected no network or filesystem gaps for Deno, got %q", desc)
+	}
+	if enforced := strings.Join(plan.Enforced, "; "); !strings.Contains(enforced, "network host allowlist (Deno --allow-net)") {
+		t.Errorf("expected Deno allowlist listed as enforced, got %q", enforced)
+	}
+}
+
+func TestDenoPermissionFlags(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	flags := denoPermissionFlags(Plugin{Name: "bare"}, "/tmp/sb")
+	want := []string{"--allow-read=/tmp/sb", "--allow-write=/tmp/sb", "--allow-env=LANG,PATH,HOME,TMPDIR,SIKI_PLUGIN"}
+	if strings.Join(flags, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v without grants, got %v", want, flags)
+	}
+
+	p := Plugin{Name: "granted", Permissions: &PluginPermissions{
+		Network: []string{"api.example.com", "cdn.example.com"},
+		Read:    []string{"~/data"},
+		Write:   []string{"/var/out"},
+		Env:     []string{"EXAMPLE_KEY"},
+	}}
+	got := strings.Join(denoPermissionFlags(p, "/tmp/sb", "SIKI_SKILL"), " ")
+	for _, w := range []string{
+		"--allow-net=api.example.com,cdn.example.com",
+		"--allow-read=/tmp/sb," + filepath.Join(home, "data") + ",/var/out",
+		"--allow-write=/tmp/sb,/var/out",
+		"--allow-env=LANG,SIKI_SKILL,PATH,HOME,TMPDIR,SIKI_PLUGIN,SIKI_ALLOWED_HOSTS,EXAMPLE_KEY",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("expected %q in %q", w, got)
+		}
+	}
+	if strings.Contains(got, "--allow-all") {
+		t.Errorf("unexpected --allow-all in %q", got)
+	}
+
+	p.Permissions.Network = []string{"*"}
+	if got := denoPermissionFlags(p, "/tmp/sb"); got[0] != "--allow-net" {
+		t.Errorf("expected unrestricted --allow-net for *, got %v", got)
+	}
+}
+
+func TestRunPlugin_SandboxEnvAndCwd(t *testing.T) {
+	home := t.TempDir()
+	os.WriteFile(filepath.Join(home, "secret.txt"), []byte("top secret"), 0644)
+	os.MkdirAll(filepath.Join(home, "data"), 0755)
+	os.WriteFile(filepath.Join(home, "data", "in.txt"), []byte("granted"), 0644)
+	t.Setenv("HOME", home)
+	t.Setenv("SIKI_TEST_SECRET", "s1")
+	t.Setenv("SIKI_TEST_GRANTED", "g1")
+
+	script := fmt.Sprintf(`#!/bin/sh
+echo "files=$(ls -A | wc -l)"
+echo "home_is_cwd=$([ "$HOME" = "$PWD" ] && echo yes)"
+echo "secret=$SIKI_TEST_SECRET granted=$SIKI_TEST_GRANTED"
+echo "secret_file=$(cat %[1]s/secret.txt 2>/dev/null)"
+echo "data=$(cat %[1]s/data/in.txt)"
+echo "ifaces=$(tail -n +3 /proc/net/dev | wc -l)"
+`, home)
+	p := Plugin{Name: "sb", Runtime: "exec",
+		Permissions: &PluginPermissions{Read: []string{"~/data"}, Env: []string{"SIKI_TEST_GRANTED"}},
+		Tool:        &PluginTool{Code: script},
+	}
+
+	res, err := runPlugin(&Config{}, p, nil)
+	if err != nil {
+		t.Fatalf("%v (logs: %s)", err, res.Logs)
+	}
+	out := res.Output
+	for _, want := range []string{"files=0", "home_is_cwd=yes", "secret= granted=g1", "data=granted"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	detectPluginSandboxCaps()
+	if pluginSandboxCaps.unshare == "" {
+		t.Logf("namespaces unavailable, gaps: %v", res.SandboxGaps)
+		return
+	}
+	if !strings.Contains(out, "secret_file=\n") {
+		t.Errorf("expected ungranted home file to be hidden:\n%s", out)
+	}
+	if !strings.Contains(out, "ifaces=1") {
+		t.Errorf("expected only loopback without network grants:\n%s", out)
+	}
+}
+
+func TestRunPlugin_ExecAndTimeout(t *testing.T) {
+	p := Plugin{Name: "sh", Runtime: "exec", Tool: &PluginTool{Code: "#!/bin/sh\ncat\n"}}
+	res, err := runPlugin(&Config{}, p, map[string]interface{}{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Output != `{"a":"b"}` {
+		t.Errorf("expected params echoed from stdin, got %q", res.Output)
+	}
+
+	p = Plugin{Name: "slow", Runtime: "exec", Timeout: 1, Tool: &PluginTool{Code: "#!/bin/sh\nexec sleep 5\n"}}
+	res, err = runPlugin(&Config{}, p, nil)
+	if err == nil || res == nil || !res.TimedOut {
+		t.Errorf("expected timeout, got %+v %v", res, err)
+	}
+}
+
+// writePluginPackage creates a package directory with plugin.json and a code file.
+func writePluginPackage(t *testing.T, version, output string) string {
+	t.Helper()
+	dir := t.TempDir()
+	manifest := fmt.Sprintf(`{"name": "greeter", "description": "Says hi", "version": %q,
+		"runtime": "exec", "tool": {"description": "greet", "parameters": {"type": "object"}, "code_file": "run.sh"}}`, version)
+	os.WriteFile(filepath.Join(dir, "plugin.json"), []byte(manifest), 0644)
+	os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\necho "+output+"\n"), 0644)
+	return dir
+}
+
+func TestInstallPlugin_DirUpdateRollback(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	src := writePluginPackage(t, "1.0.0", "hello")
+	p, err := installPlugin(&Config{}, src, PluginInstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source == nil || p.Source.Type != "dir" || len(p.Source.SHA256) != 64 {
+		t.Fatalf("expected dir provenance with sha256, got %+v", p.Source)
+	}
+	if !strings.Contains(p.Tool.Code, "echo hello") || p.Tool.CodeFile != "" {
+		t.Errorf("expected code_file to be inlined, got %+v", p.Tool)
+	}
+
+	// Update from the recorded source after the package changed
+	os.WriteFile(filepath.Join(src, "plugin.json"), []byte(strings.Replace(mustReadFile(t, filepath.Join(src, "plugin.json")), "1.0.0", "1.1.0", 1)), 0644)
+	os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\necho broken\n"), 0644)
+	p, err = updatePlugin(&Config{}, "greeter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != "1.1.0" {
+		t.Errorf("expected 1.1.0 after update, got %s", p.Version)
+	}
+	if versions := listPluginVersions("greeter"); len(versions) != 1 || versions[0].Version != "1.0.0" {
+		t.Fatalf("expected previous version to be kept, got %+v", versions)
+	}
+
+	p, err = rollbackPlugin("greeter", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != "1.0.0" || !strings.Contains(p.Tool.Code, "echo hello") {
+		t.Errorf("expected rollback to 1.0.0, got %s", p.Version)
+	}
+	loaded, _ := findLoadedPlugin("greeter")
+	if loaded.Version != "1.0.0" {
+		t.Errorf("expected reloaded plugin to be 1.0.0, got %s", loaded.Version)
+	}
+	// The rolled-back-from version is archived so it can be restored again
+	if versions := listPluginVersions("greeter"); len(versions) != 1 || versions[0].Version != "1.1.0" {
+		t.Errorf("expected 1.1.0 in history after rollback, got %+v", versions)
+	}
+}
+
+func TestListPluginVersions_NewestFirst(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	for _, v := range []string{"1.9", "1.10", "1.9"} {
+		if err := archivePluginVersion(Plugin{Name: "sorted", Version: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for _, v := range listPluginVersions("sorted") {
+		got = append(got, v.Version)
+	}
+	if strings.Join(got, " ") != "1.9 1.10 1.9" {
+		t.Errorf("expected archive order newest first, got %v", got)
+	}
+}
+
+func TestCopyPackageDir_SkipsSymlinks(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a"), 0644)
+	os.Symlink(outside, filepath.Join(src, "sub", "leak.txt"))
+	os.Symlink(filepath.Dir(outside), filepath.Join(src, "leakdir"))
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := copyPackageDir(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if mustReadFile(t, filepath.Join(dst, "sub", "a.txt")) != "a" {
+		t.Error("expected regular file to be copied")
+	}
+	for _, name := range []string{"sub/leak.txt", "leakdir"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("expected symlink %s to be skipped, got %v", name, err)
+		}
+	}
+
+	if err := copyPackageDir(filepath.Join(src, "missing"), dst); err == nil {
+		t.Error("expected an error for a missing source")
+	}
+}
+
+func TestInstallPlugin_ArchivesAndIntegrity(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	src := writePluginPackage(t, "2.0.0", "zipped")
+	digest, err := hashPluginPackage(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// zip with a wrapping top-level directory
+	zipPath := filepath.Join(t.TempDir(), "greeter.zip")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"plugin.json", "run.sh"} {
+		fw, _ := zw.Create("greeter-2.0.0/" + name)
+		fw.Write([]byte(mustReadFile(t, filepath.Join(src, name))))
+	}
+	zw.Close()
+	os.WriteFile(zipPath, buf.Bytes(), 0644)
+
+	if _, err := installPlugin(&Config{}, zipPath, PluginInstallOptions{SHA256: strings.Repeat("0", 64)}); err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Fatalf("expected sha256 mismatch, got %v", err)
+	}
+	p, err := installPlugin(&Config{}, zipPath, PluginInstallOptions{SHA256: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source.Type != "archive" || p.Source.SHA256 != digest {
+		t.Errorf("unexpected provenance: %+v", p.Source)
+	}
+
+	// tar.gz of the same package
+	tgzPath := filepath.Join(t.TempDir(), "greeter.tar.gz")
+	if out, err := exec.Command("tar", "-czf", tgzPath, "-C", src, ".").CombinedOutput(); err != nil {
+		t.Skipf("tar unavailable: %v %s", err, out)
+	}
+	p, err = installPlugin(&Config{}, tgzPath, PluginInstallOptions{SHA256: digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source.SHA256 != digest {
+		t.Errorf("expected same digest for tar.gz, got %s", p.Source.SHA256)
+	}
+}
+
+func TestInstallPlugin_Git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available, skipping")
+	}
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	src := writePluginPackage(t, "3.0.0", "gitted")
+	for _, args := range [][]string{
+		{"init", "-q"}, {"add", "."},
+		{"-c", "user.email=t@example.com", "-c", "user.name=t", "commit", "-qm", "init"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", src}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+
+	if _, err := installPlugin(&Config{}, "file://"+src, PluginInstallOptions{}); err == nil {
+		t.Fatal("expected file:// git source to be refused")
+	}
+	for _, source := range []string{"--upload-pack=touch /tmp/pwned", "https://example.com/repo.git#--upload-pack=x", "ext::sh -c id"} {
+		if _, err := installPlugin(&Config{}, source, PluginInstallOptions{}); err == nil {
+			t.Errorf("expected %q to be refused", source)
+		}
+	}
+
+	orig := pluginGitSchemes
+	pluginGitSchemes = append([]string{"file://"}, orig...)
+	defer func() { pluginGitSchemes = orig }()
+	p, err := installPlugin(&Config{}, "file://"+src, PluginInstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Source.Type != "git" || len(p.Source.Commit) != 40 {
+		t.Errorf("expected git provenance with commit, got %+v", p.Source)
+	}
+}
+
+func TestHandlePluginPackages(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	ws := NewWebServer(&Config{})
+	src := writePluginPackage(t, "1.0.0", "hi")
+	body, _ := json.Marshal(map[string]string{"source": src})
+	w := httptest.NewRecorder()
+	ws.handlePluginPackages(w, httptest.NewRequest("POST", "/api/plugins/install", bytes.NewReader(body)))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"installed"`) {
+		t.Fatalf("install failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ws.handlePluginPackages(w, httptest.NewRequest("POST", "/api/plugins/rollback", strings.NewReader(`{"name":"greeter"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "no previous version") {
+		t.Errorf("expected rollback without history to fail, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ws.handlePlugins(w, httptest.NewRequest("GET", "/api/plugins", nil))
+	if !strings.Contains(w.Body.String(), `"sha256"`) {
+		t.Errorf("expected provenance in plugin list, got %s", w.Body.String())
+	}
+}
+
+func TestEvalJSONPath(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"items": [{"name": "a"}, {"name": "b", "tags": ["x"]}], "count": 2, "odd key": true}`), &doc)
+	cases := map[string]interface{}{
+		"$.count":             float64(2),
+		"$.items[1].name":     "b",
+		"$.items[-1].tags[0]": "x",
+		"$['odd key']":        true,
+	}
+	for path, want := range cases {
+		got, err := evalJSONPath(doc, path)
+		if err != nil || !jsonValuesEqual(want, got) {
+			t.Errorf("%s: expected %v, got %v (%v)", path, want, got, err)
+		}
+	}
+	if _, err := evalJSONPath(doc, "$.items[5]"); err == nil {
+		t.Error("expected out of range error")
+	}
+	if _, err := evalJSONPath(doc, "$.missing"); err == nil {
+		t.Error("expected missing key error")
+	}
+}
+
+func TestPluginTestCheck_Matchers(t *testing.T) {
+	five := "5"
+	out := `{"sum": 5, "label": "total"}`
+	pass := []PluginTest{
+		{Contains: "total"},
+		{Expected: "sum"},
+		{Regex: `"sum":\s*\d+`},
+		{JSONPath: "$.sum", Value: float64(5)},
+		{JSONPath: "$.sum", Value: "5"},
+		{JSONPath: "$.label"},
+	}
+	for i, tc := range pass {
+		if f := tc.check(out, nil); len(f) != 0 {
+			t.Errorf("case %d: expected pass, got %v", i, f)
+		}
+	}
+	fail := []PluginTest{
+		{Equals: &five},
+		{Contains: "missing"},
+		{Regex: `^\d+$`},
+		{JSONPath: "$.sum", Value: float64(6)},
+		{ExpectError: true},
+	}
+	for i, tc := range fail {
+		if f := tc.check(out, nil); len(f) == 0 {
+			t.Errorf("case %d: expected failure", i)
+		}
+	}
+	if f := (PluginTest{ExpectError: true}).check("", errors.New("boom")); len(f) != 0 {
+		t.Errorf("expected expect_error to pass on error, got %v", f)
+	}
+}
+
+func TestTestPlugin_StructuredReport(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	eq := "hello"
+	storePlugin(Plugin{Name: "echoer", Version: "1.0", Runtime: "exec",
+		Tool:  &PluginTool{Code: "#!/bin/sh\necho hello\n"},
+		Tests: []PluginTest{{Name: "greets", Equals: &eq}},
+	})
+	agent := &Agent{config: &Config{}}
+
+	out, err := agent.testPlugin("echoer", `[{"input": {}, "expected": "hell"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "2/2 passed") || !strings.Contains(out, "marked as TESTED") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	p, _ := findLoadedPlugin("echoer")
+	if !p.Tested || p.TestReport == nil || p.TestReport.Total != 2 || len(p.Tests) != 2 {
+		t.Fatalf("expected structured report and merged tests, got %+v", p)
+	}
+
+	// A failing case flips Tested back off
+	out, _ = agent.testPlugin("echoer", `[{"name": "wrong", "input": {}, "equals": "bye"}]`)
+	p, _ = findLoadedPlugin("echoer")
+	if p.Tested || p.TestReport.Failed != 1 || !strings.Contains(out, "wrong: FAIL") {
+		t.Errorf("expected failing report, got tested=%v %s", p.Tested, out)
+	}
+}
+
+func TestCreatePlugin_RegressionDisables(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	agent := &Agent{config: &Config{}}
+
+	_, err := agent.createPlugin(map[string]interface{}{
+		"name": "counter", "description": "counts", "runtime": "exec",
+		"tool_code": "#!/bin/sh\necho 42\n",
+		"tests":     []interface{}{map[string]interface{}{"input": map[string]interface{}{}, "equals": "42"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := agent.testPlugin("counter", ""); !strings.Contains(out, "TESTED") {
+		t.Fatalf("expected initial tests to pass: %s", out)
+	}
+
+	// Edit without tests: existing manifest tests are kept and re-run
+	out, err := agent.createPlugin(map[string]interface{}{
+		"name": "counter", "description": "counts", "runtime": "exec",
+		"tool_code": "#!/bin/sh\necho 41\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := findLoadedPlugin("counter")
+	if !strings.Contains(out, "REGRESSED") || p.IsEnabled() || p.Tested || p.DisabledReason != "regression" {
+		t.Fatalf("expected regression to disable plugin, got %+v\n%s", p, out)
+	}
+
+	// A hand edit that fixes the code is re-enabled by test_plugin
+	p.Tool.Code = "#!/bin/sh\necho 42\n"
+	storePlugin(p)
+	out, _ = agent.testPlugin("counter", "")
+	p, _ = findLoadedPlugin("counter")
+	if !p.IsEnabled() || !p.Tested || !strings.Contains(out, "re-enabled") {
+		t.Errorf("expected plugin to be re-enabled after passing tests, got %+v\n%s", p, out)
+	}
+
+	// Regress again, then fix through create_plugin: the edit itself re-enables it
+	agent.createPlugin(map[string]interface{}{
+		"name": "counter", "description": "counts", "runtime": "exec",
+		"tool_code": "#!/bin/sh\necho 0\n",
+	})
+	out, _ = agent.createPlugin(map[string]interface{}{
+		"name": "counter", "description": "counts", "runtime": "exec",
+		"tool_code": "#!/bin/sh\necho 42\n",
+	})
+	p, _ = findLoadedPlugin("counter")
+	if !p.IsEnabled() || !p.Tested || !strings.Contains(out, "[TESTED]") {
+		t.Errorf("expected fixing edit to re-enable plugin, got %+v\n%s", p, out)
+	}
+}
+
+func TestRunPluginCommand_Test(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	savePlugin(Plugin{Name: "ok", Version: "1.0", Runtime: "exec",
+		Tool:  &PluginTool{Code: "#!/bin/sh\necho fine\n"},
+		Tests: []PluginTest{{Contains: "fine"}},
+	})
+	savePlugin(Plugin{Name: "bad", Version: "1.0", Runtime: "exec",
+		Tool:  &PluginTool{Code: "#!/bin/sh\necho nope\n"},
+		Tests: []PluginTest{{Contains: "fine"}},
+	})
+	if err := runPluginCommand(&Config{}, []string{"test", "ok"}, PluginInstallOptions{}); err != nil {
+		t.Errorf("expected passing plugin, got %v", err)
+	}
+	if err := runPluginCommand(&Config{}, []string{"test", "bad"}, PluginInstallOptions{}); err == nil {
+		t.Error("expected failing plugin to return an error")
+	}
+	p, _ := findLoadedPlugin("ok")
+	if !p.Tested || p.TestReport == nil {
+		t.Errorf("expected headless run to record the report, got %+v", p)
+	}
+}
+
+func TestParseCronSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		return tm
+	}
+	cases := []struct {
+		spec string
+		t    string
+		want bool
+	}{
+		{"*/15 * * * *", "2026-10-19 10:30", true},
+		{"*/15 * * * *", "2026-10-19 10:31", false},
+		{"0 9-17 * * 1-5", "2026-10-19 09:00", true},  // Monday
+		{"0 9-17 * * 1-5", "2026-10-18 09:00", false}, // Sunday
+		{"0 0 1 * 0", "2026-10-18 00:00", true},       // dom or dow: Sunday
+		{"0 0 1 * 0", "2026-10-01 00:00", true},       // dom or dow: the 1st
+		{"@hourly", "2026-10-19 11:00", true},
+		{"@daily", "2026-10-19 11:00", false},
+		{"30 8 * * 7", "2026-10-18 08:30", true}, // 7 is Sunday too
+	}
+	for _, c := range cases {
+		sched, err := parseCronSchedule(c.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", c.spec, err)
+		}
+		if got := sched.due(at(c.t), time.Time{}); got != c.want {
+			t.Errorf("%s at %s: expected %v, got %v", c.spec, c.t, c.want, got)
+		}
+	}
+
+	// Same minute never fires twice
+	sched, _ := parseCronSchedule("* * * * *")
+	now := at("2026-10-19 10:30")
+	if sched.due(now.Add(20*time.Second), now) {
+		t.Error("expected no second run within the same minute")
+	}
+
+	every, _ := parseCronSchedule("@every 10m")
+	if every.due(now.Add(5*time.Minute), now) || !every.due(now.Add(10*time.Minute), now) {
+		t.Error("unexpected @every behavior")
+	}
+
+	for _, bad := range []string{"* * *", "61 * * * *", "*/0 * * * *", "@every 10s", "a * * * *"} {
+		if _, err := parseCronSchedule(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestValidatePluginTriggers(t *testing.T) {
+	tool := &PluginTool{Code: "x"}
+	bad := []Plugin{
+		{Tool: tool, Triggers: []PluginTrigger{{Name: "h", Type: "webhook"}}},
+		{Tool: tool, Triggers: []PluginTrigger{{Name: "s", Type: "schedule", Schedule: "nope"}}},
+		{Tool: tool, Triggers: []PluginTrigger{{Name: "x", Type: "email"}}},
+		{Triggers: []PluginTrigger{{Name: "s", Type: "schedule", Schedule: "@hourly"}}},
+	}
+	for i, p := range bad {
+		if err := validatePluginTriggers(p); err == nil {
+			t.Errorf("case %d: expected validation error", i)
+		}
+	}
+	ok := Plugin{Tool: tool, Triggers: []PluginTrigger{
+		{Name: "h", Type: "webhook", Secret: "s3cret"},
+		{Name: "s", Type: "schedule", Schedule: "@every 1h"},
+	}}
+	if err := validatePluginTriggers(ok); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHandlePluginHook(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	storePlugin(Plugin{Name: "hooked", Version: "1.0", Runtime: "exec",
+		Tool: &PluginTool{Code: "#!/bin/sh\ncat\n"},
+		Triggers: []PluginTrigger{{Name: "push", Type: "webhook", Secret: "s3cret",
+			Params: map[string]interface{}{"source": "hook"}, Thread: true}},
+	})
+	ws := NewWebServer(&Config{})
+
+	body := `{"ref": "main"}`
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/plugins/hooked/hook", strings.NewReader(body))
+	req.Header.Set("X-Siki-Secret", "wrong")
+	ws.handlePluginHook(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong secret, got %d", w.Code)
+	}
+
+	// GitHub-style HMAC signature
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/api/plugins/hooked/hook/push", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	ws.handlePluginHook(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	var run PluginTriggerRun
+	json.NewDecoder(w.Body).Decode(&run)
+	if !run.OK || !strings.Contains(run.Output, `"ref":"main"`) || !strings.Contains(run.Output, `"source":"hook"`) {
+		t.Errorf("expected merged params echoed, got %+v", run)
+	}
+	if run.ThreadID == "" {
+		t.Fatal("expected a proactive thread for the result")
+	}
+	thread, err := loadThreadMeta(run.ThreadID)
+	if err != nil || !thread.Proactive || !thread.Unread || thread.MessageCount != 2 {
+		t.Errorf("unexpected thread: %+v %v", thread, err)
+	}
+
+	// History shows up in /api/plugins
+	w = httptest.NewRecorder()
+	ws.handlePlugins(w, httptest.NewRequest("GET", "/api/plugins", nil))
+	var list []struct {
+		Name     string              `json:"name"`
+		Triggers []PluginTriggerInfo `json:"triggers"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || len(list[0].Triggers) != 1 || len(list[0].Triggers[0].History) != 1 {
+		t.Fatalf("expected trigger history in plugin list, got %+v", list)
+	}
+	if strings.Contains(w.Body.String(), "s3cret") {
+		t.Error("webhook secret must not be exposed")
+	}
+}
+
+func TestFirePluginSchedules(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	storePlugin(Plugin{Name: "ticker", Version: "1.0", Runtime: "exec",
+		Tool:     &PluginTool{Code: "#!/bin/sh\necho tick\n"},
+		Triggers: []PluginTrigger{{Name: "minutely", Type: "schedule", Schedule: "* * * * *"}},
+	})
+	ws := NewWebServer(&Config{})
+	now := time.Now()
+	ws.firePluginSchedules(now, now.Add(-time.Hour))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if runs := loadPluginTriggerHistory("ticker")["minutely"]; len(runs) == 1 {
+			if !runs[0].OK || runs[0].Output != "tick" {
+				t.Errorf("unexpected run: %+v", runs[0])
+			}
+			// Already ran this minute
+			ws.firePluginSchedules(now, now.Add(-time.Hour))
+			time.Sleep(200 * time.Millisecond)
+			if n := len(loadPluginTriggerHistory("ticker")["minutely"]); n != 1 {
+				t.Errorf("expected a single run per minute, got %d", n)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("scheduled trigger did not run")
+}
+
+func TestPluginUIFrame(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	storePlugin(Plugin{Name: "panel", Version: "1.0",
+		UI: &PluginUI{JS: "pane.innerHTML = '</script><b>hi</b>';", CSS: "b{color:red}", API: []string{"send_message"}}})
+	ws := NewWebServer(&Config{})
+
+	w := httptest.NewRecorder()
+	ws.handlePluginUIFrame(w, httptest.NewRequest("GET", "/plugin-ui/panel", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	csp := w.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || !strings.Contains(csp, "sandbox allow-scripts") {
+		t.Errorf("expected restrictive CSP, got %q", csp)
+	}
+	body := w.Body.String()
+	if strings.Count(body, "</script>") != 1 {
+		t.Error("plugin JS must not be able to close the bridge script")
+	}
+	if !strings.Contains(body, "new Function('pane', 'siki', JS)") {
+		t.Error("expected plugin JS to run through the bridge")
+	}
+
+	w = httptest.NewRecorder()
+	ws.handlePluginsUI(w, httptest.NewRequest("GET", "/api/plugins/ui", nil))
+	if strings.Contains(w.Body.String(), "innerHTML") || !strings.Contains(w.Body.String(), `"url":"/plugin-ui/panel"`) {
+		t.Errorf("expected frame URL instead of raw JS, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ws.handlePluginUIFrame(w, httptest.NewRequest("GET", "/plugin-ui/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown plugin, got %d", w.Code)
+	}
+
+	if err := validatePluginUI(Plugin{UI: &PluginUI{API: []string{"read_files"}}}); err == nil {
+		t.Error("expected unknown UI API to be rejected")
+	}
+}
+
+func TestPluginUICall(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	storePlugin(Plugin{Name: "calc", Version: "1.0", Runtime: "exec",
+		Tool: &PluginTool{Code: "#!/bin/sh\ncat\n", Parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"n": map[string]interface{}{"type": "integer"}},
+		}},
+		UI: &PluginUI{JS: "pane.textContent = 'calc';", API: []string{"call_tool"}}})
+	config := &Config{}
+
+	call := func(method string, params map[string]interface{}) (map[string]interface{}, int, error) {
+		return runPluginUICall(config, PluginUICall{Plugin: "calc", Version: pluginUIAPIVersion, Method: method, Params: params})
+	}
+
+	resp, _, err := call("call_tool", map[string]interface{}{"args": map[string]interface{}{"n": "3"}})
+	if err != nil {
+		t.Fatalf("call_tool failed: %v", err)
+	}
+	if out, _ := resp["result"].(string); !strings.Contains(out, `"n":3`) {
+		t.Errorf("expected coerced args echoed, got %v", resp["result"])
+	}
+
+	if _, status, err := call("send_message", map[string]interface{}{"text": "hi"}); err == nil || status != http.StatusForbidden {
+		t.Errorf("expected undeclared send_message to be forbidden, got %d %v", status, err)
+	}
+	if _, status, _ := runPluginUICall(config, PluginUICall{Plugin: "calc", Version: 2, Method: "call_tool"}); status != http.StatusBadRequest {
+		t.Errorf("expected unsupported version to be rejected, got %d", status)
+	}
+	if _, status, _ := call("call_tool", map[string]interface{}{"args": map[string]interface{}{"n": "x"}}); status != http.StatusBadRequest {
+		t.Errorf("expected invalid args to be rejected, got %d", status)
+	}
+	if _, status, _ := runPluginUICall(config, PluginUICall{Plugin: "other", Version: pluginUIAPIVersion, Method: "call_tool"}); status != http.StatusNotFound {
+		t.Errorf("expected unknown plugin to be rejected, got %d", status)
+	}
+}
+
+// ============================================================================
+// 8. HTTP Handler Tests
+// ============================================================================
+
+func TestHandleStatus(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	cfg := testConfig(server.URL)
+	ws := NewWebServer(cfg)
+
+	req := httptest.NewRequest("GET", "/api/status", nil)
+	w := httptest.NewRecorder()
+	ws.handleStatus(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	var resp StatusResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Model != "test-model" || resp.Backend != "ollama" || resp.Version != Version {
+		t.Errorf("unexpected status: %+v", resp)
+	}
+	if resp.VisionModel != "test-vision" {
+		t.Errorf("expected vision model, got %q", resp.VisionModel)
+	}
+}
+
+func TestHandleThreads_CRUD(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	cfg := testConfig(server.URL)
+	ws := NewWebServer(cfg)
+
+	// Create
+	body := `{"id":"th-1","title":"Test"}`
+	req := httptest.NewRequest("POST", "/api/threads", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	if w.Code != 200 {
+		t.Errorf("create: expected 200, got %d", w.Code)
+	}
+
+	// List
+	req = httptest.NewRequest("GET", "/api/threads", nil)
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	var threads []ThreadListItem
+	json.NewDecoder(w.Body).Decode(&threads)
+	if len(threads) != 1 || threads[0].ID != "th-1" {
+		t.Errorf("list unexpected: %+v", threads)
+	}
+
+	// Get single
+	req = httptest.NewRequest("GET", "/api/threads/th-1", nil)
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	var thread Thread
+	json.NewDecoder(w.Body).Decode(&thread)
+	if thread.ID != "th-1" || thread.Title != "Test" {
+		t.Errorf("get unexpected: %+v", thread)
+	}
+
+	// Rename (POST not PUT)
+	req = httptest.NewRequest("POST", "/api/threads/th-1/rename", strings.NewReader(`{"title":"Renamed"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	if w.Code != 200 {
+		t.Errorf("rename: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	meta, _ := loadThreadMeta("th-1")
+	if meta.Title != "Renamed" {
+		t.Errorf("expected 'Renamed', got %q", meta.Title)
+	}
+
+	// Delete
+	req = httptest.NewRequest("DELETE", "/api/threads/th-1", nil)
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	if w.Code != 200 {
+		t.Errorf("delete: expected 200, got %d", w.Code)
+	}
+	threads2, _ := listThreads()
+	if len(threads2) != 0 {
+		t.Error("thread should be deleted")
+	}
+}
+
+func TestHandleThreads_GetNotFound(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	req := httptest.NewRequest("GET", "/api/threads/nonexistent", nil)
+	w := httptest.NewRecorder()
+	ws.handleThreads(w, req)
+	if w.Code != 404 {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestHandlePlugins_List(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	loadedPlugins = []Plugin{
+		{Name: "p1", Description: "Plugin 1", Version: "1.0"},
+	}
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	req := httptest.NewRequest("GET", "/api/plugins", nil)
+	w := httptest.NewRecorder()
+	ws.handlePlugins(w, req)
+
+	var plugins []Plugin
+	json.NewDecoder(w.Body).Decode(&plugins)
+	if len(plugins) != 1 || plugins[0].Name != "p1" {
+		t.Errorf("unexpected plugins: %+v", plugins)
+	}
+}
+
+func TestHandleUpload_SingleFile(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	// Create multipart form
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, _ := writer.CreateFormFile("files", "test.txt")
+	part.Write([]byte("hello world"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &buf)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	ws.handleUpload(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Check file exists in workspace
+	content, err := os.ReadFile(filepath.Join(dockerWorkspaceDir, "test.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello world" {
+		t.Errorf("file content = %q", content)
+	}
+}
+
+func TestHandleSettings_SetProviders(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	cfg := testConfig(server.URL)
+	ws := NewWebServer(cfg)
+
+	body := `{"action":"set_providers","providers":[{"name":"new","backend":"openai","endpoint":"https://api.openai.com/v1","model":"gpt-4","api_key":"sk-test"}]}`
+	req := httptest.NewRequest("POST", "/api/settings", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ws.handleSettings(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(cfg.Providers) != 1 || cfg.Providers[0].Name != "new" {
+		t.Errorf("providers not updated: %+v", cfg.Providers)
+	}
+}
+
+func TestHandleDockerStatus(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, staticLLMResponse("ok"))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	req := httptest.NewRequest("GET", "/api/docker/status", nil)
+	w := httptest.NewRecorder()
+	ws.handleDockerStatus(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	var resp map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if _, ok := resp["docker_available"]; !ok {
+		t.Error("expected 'docker_available' field in response")
+	}
+}
+
+// ============================================================================
+// 9. Agent / LLM Tests
+// ============================================================================
+
+func TestAgentChat_SimpleResponse(t *testing.T) {
+	server := mockLLMServer(t, staticLLMResponse("Hello from mock!"))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	agent := &Agent{
+		config:   cfg,
+		messages: []Message{{Role: "system", Content: "test"}},
+	}
+
+	agent.messages = append(agent.messages, Message{Role: "user", Content: "hi"})
+	resp, err := agent.chat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "Hello from mock!" {
+		t.Errorf("expected 'Hello from mock!', got %q", resp.Content)
+	}
+}
+
+func TestAgentChat_ServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal error", 500)
+	}))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	agent := &Agent{
+		config:   cfg,
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "hi"}},
+	}
+
+	_, err := agent.chat(context.Background())
+	if err == nil {
+		t.Error("expected error for 500 response")
+	}
+}
+
+func TestAgentChatStream_BasicContent(t *testing.T) {
+	chunks := []string{"Hello", " ", "World", "!"}
+	server := mockLLMServer(t, streamingLLMResponse(chunks))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	agent := &Agent{
+		config:   cfg,
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "hi"}},
+	}
+
+	var collected []string
+	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
+		OnContent: func(s string) { collected = append(collected, s) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "Hello World!" {
+		t.Errorf("expected 'Hello World!', got %q", resp.Content)
+	}
+	if len(collected) == 0 {
+		t.Error("OnContent should have been called")
+	}
+}
+
+func TestAgentChatStream_ThinkTags(t *testing.T) {
+	chunks := []string{"<think>reasoning here</think>The answer is 42."}
+	server := mockLLMServer(t, streamingLLMResponse(chunks))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	agent := &Agent{
+		config:   cfg,
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "meaning of life?"}},
+	}
+
+	var thinkParts []string
+	var contentParts []string
+	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
+		OnContent:  func(s string) { contentParts = append(contentParts, s) },
+		OnThinking: func(s string) { thinkParts = append(thinkParts, s) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Thinking != "reasoning here" {
+		t.Errorf("expected thinking 'reasoning here', got %q", resp.Thinking)
+	}
+	if resp.Content != "The answer is 42." {
+		t.Errorf("expected content 'The answer is 42.', got %q", resp.Content)
+	}
+}
+
+func TestHandleStreamingResponse_ThinkTagAcrossChunks(t *testing.T) {
+	// Simulate <think> tag content split across SSE chunks
+	// Split: "<think>reas" | "oning</think>answer"
+	chunks := []string{"<think>reas", "oning</think>answer"}
+	server := mockLLMServer(t, streamingLLMResponse(chunks))
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	agent := &Agent{
+		config:   cfg,
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "test"}},
+	}
+
+	var contentParts []string
+	var thinkParts []string
+	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
+		OnContent:  func(s string) { contentParts = append(contentParts, s) },
+		OnThinking: func(s string) { thinkParts = append(thinkParts, s) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Thinking != "reasoning" {
+		t.Errorf("expected thinking 'reasoning', got %q", resp.Thinking)
+	}
+	if resp.Content != "answer" {
+		t.Errorf("expected content 'answer', got %q", resp.Content)
+	}
+}
+
+// textToolCallFixtures is a corpus of tool calls small models emit as plain text.
+var textToolCallFixtures = []struct {
+	name      string
+	content   string
+	wantTools []string
+	wantArgs  []string // JSON arguments, same order as wantTools
+	wantText  string   // content left after recovery
+}{
+	{
+		name:      "hermes tool_call tag",
+		content:   `<tool_call>{"name": "web_search", "arguments": {"query": "golang generics"}}</tool_call>`,
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"golang generics"}`},
+	},
+	{
+		name:      "tool_call tag with text around and string arguments",
+		content:   "調べます。\n<tool_call>\n{\"name\": \"web_fetch\", \"arguments\": \"{\\\"url\\\": \\\"https://example.com\\\"}\"}\n</tool_call>",
+		wantTools: []string{"web_fetch"},
+		wantArgs:  []string{`{"url":"https://example.com"}`},
+		wantText:  "調べます。",
+	},
+	{
+		name:      "unterminated tool_call tag",
+		content:   `<tool_call>{"name": "web_search", "arguments": {"query": "x"}}`,
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"x"}`},
+	},
+	{
+		name:      "multiple tool_call tags",
+		content:   `<tool_call>{"name":"web_search","arguments":{"query":"a"}}</tool_call><tool_call>{"name":"web_fetch","arguments":{"url":"https://b"}}</tool_call>`,
+		wantTools: []string{"web_search", "web_fetch"},
+		wantArgs:  []string{`{"query":"a"}`, `{"url":"https://b"}`},
+	},
+	{
+		name:      "fenced json with parameters key",
+		content:   "Sure:\n```json\n{\"name\": \"web_search\", \"parameters\": {\"query\": \"tokyo weather\"}}\n```",
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"tokyo weather"}`},
+		wantText:  "Sure:",
+	},
+	{
+		name:      "fenced json nested function object",
+		content:   "```\n{\"function\": {\"name\": \"web_search\", \"arguments\": {\"query\": \"q\"}}}\n```",
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"q"}`},
+	},
+	{
+		name:      "fenced json array of calls",
+		content:   "```json\n[{\"tool\": \"web_search\", \"args\": {\"query\": \"a\"}}, {\"tool\": \"web_fetch\", \"args\": {\"url\": \"https://b\"}}]\n```",
+		wantTools: []string{"web_search", "web_fetch"},
+		wantArgs:  []string{`{"query":"a"}`, `{"url":"https://b"}`},
+	},
+	{
+		name:      "functions dot call",
+		content:   `functions.web_search({"query": "braces } in \"string\""})`,
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"braces } in \"string\""}`},
+	},
+	{
+		name:      "harmony header",
+		content:   `<|start|>assistant<|channel|>commentary to=functions.web_fetch <|constrain|>json<|message|>{"url": "https://example.com"}<|call|>`,
+		wantTools: []string{"web_fetch"},
+		wantArgs:  []string{`{"url":"https://example.com"}`},
+	},
+	{
+		name:      "harmony header without start token",
+		content:   `to=functions.web_search json {"query": "siki"}`,
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"siki"}`},
+	},
+	{
+		name:      "undeclared params are dropped",
+		content:   `<tool_call>{"name": "web_search", "arguments": {"query": "x", "bogus": 1}}</tool_call>`,
+		wantTools: []string{"web_search"},
+		wantArgs:  []string{`{"query":"x"}`},
+	},
+	{
+		name:     "unknown tool is left as text",
+		content:  `<tool_call>{"name": "launch_rockets", "arguments": {}}</tool_call>`,
+		wantText: `<tool_call>{"name": "launch_rockets", "arguments": {}}</tool_call>`,
+	},
+	{
+		name:     "missing required param is left as text",
+		content:  `functions.web_fetch({})`,
+		wantText: `functions.web_fetch({})`,
+	},
+	{
+		name:     "ordinary fenced json is not a tool call",
+		content:  "```json\n{\"name\": \"Alice\", \"age\": 30}\n```",
+		wantText: "```json\n{\"name\": \"Alice\", \"age\": 30}\n```",
+	},
+	{
+		name:     "plain prose",
+		content:  "The answer is 42.",
+		wantText: "The answer is 42.",
+	},
+}
+
+func TestRecoverTextToolCalls_Fixtures(t *testing.T) {
+	t.Parallel()
+	for _, fx := range textToolCallFixtures {
+		text, calls := recoverTextToolCalls(fx.content, tools)
+		if len(calls) != len(fx.wantTools) {
+			t.Errorf("%s: expected %d calls, got %d (%+v)", fx.name, len(fx.wantTools), len(calls), calls)
+			continue
+		}
+		for i, c := range calls {
+			if c.Function.Name != fx.wantTools[i] {
+				t.Errorf("%s: call %d: expected %s, got %s", fx.name, i, fx.wantTools[i], c.Function.Name)
+			}
+			if c.Function.Arguments != fx.wantArgs[i] {
+				t.Errorf("%s: call %d: expected args %s, got %s", fx.name, i, fx.wantArgs[i], c.Function.Arguments)
+			}
+			if c.ID == "" || c.Type != "function" {
+				t.Errorf("%s: call %d: missing ID or type: %+v", fx.name, i, c)
+			}
+		}
+		if text != fx.wantText {
+			t.Errorf("%s: expected remaining text %q, got %q", fx.name, fx.wantText, text)
+		}
+	}
+}
+
+func TestAgentChatStream_RecoversTextToolCall(t *testing.T) {
+	chunks := []string{"<tool_call>{\"name\": \"web_se", "arch\", \"arguments\": {\"query\": \"go\"}}</tool_call>"}
+	server := mockLLMServer(t, streamingLLMResponse(chunks))
+	defer server.Close()
+
+	agent := &Agent{
+		config:   testConfig(server.URL),
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "search go"}},
+	}
+	resp, err := agent.chatStream(context.Background(), StreamCallbacks{OnContent: func(string) {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Name != "web_search" {
+		t.Fatalf("expected recovered web_search call, got %+v", resp.ToolCalls)
+	}
+	if resp.Content != "" {
+		t.Errorf("expected tool call text stripped from content, got %q", resp.Content)
+	}
+}
+
+func TestAgentChat_RecoversTextToolCall(t *testing.T) {
+	server := mockLLMServer(t, staticLLMResponse(`functions.web_fetch({"url": "https://example.com"})`))
+	defer server.Close()
+
+	agent := &Agent{
+		config:   testConfig(server.URL),
+		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "fetch"}},
+	}
+	resp, err := agent.chat(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Function.Arguments != `{"url":"https://example.com"}` {
+		t.Errorf("expected recovered web_fetch call, got %+v", resp.ToolCalls)
+	}
+
+	// Tools that were not offered this turn are left as text
+	msg := &Message{Role: "assistant", Content: `functions.web_fetch({"url": "https://example.com"})`}
+	applyTextToolCallRecovery(msg, []Tool{{Name: "web_search"}})
+	if len(msg.ToolCalls) != 0 || msg.Content == "" {
+		t.Errorf("expected no recovery for a tool that was not offered, got %+v", msg)
+	}
+}
+
+func TestValidateToolArgs_CoercesCommonMistakes(t *testing.T) {
+	t.Parallel()
+	// twitter_search: query string, max_results integer
+	args, verr := validateToolArgs("twitter_search", map[string]interface{}{
+		"query":       42.0,
+		"max_results": "10",
+		"bogus":       nil,
+	})
+	if verr != nil {
+		t.Fatalf("unexpected error: %v", verr)
+	}
+	if args["query"] != "42" {
+		t.Errorf("expected number coerced to string '42', got %#v", args["query"])
+	}
+	if args["max_results"] != 10.0 {
+		t.Errorf("expected numeric string coerced to 10, got %#v", args["max_results"])
+	}
+	if _, ok := args["bogus"]; ok {
+		t.Error("null optional args should be dropped")
+	}
+}
+
+func TestValidateToolArgs_StructuredError(t *testing.T) {
+	t.Parallel()
+	_, verr := validateToolArgs("twitter_search", map[string]interface{}{"max_results": "lots"})
+	if verr == nil {
+		t.Fatal("expected validation error")
+	}
+	if len(verr.Issues) != 2 {
+		t.Fatalf("expected 2 issues (type + required), got %+v", verr.Issues)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(verr.Error()), &parsed); err != nil {
+		t.Fatalf("error message should be JSON: %v", err)
+	}
+	if parsed["error"] != "invalid_arguments" || parsed["tool"] != "twitter_search" {
+		t.Errorf("unexpected error payload: %v", parsed)
+	}
+}
+
+func TestCheckSchemaValue_EnumsRangesAndArrays(t *testing.T) {
+	t.Parallel()
+	enumProp := map[string]interface{}{"type": "string", "enum": []string{"fast", "slow"}}
+	if v, issue := checkSchemaValue("mode", "FAST", enumProp); issue != nil || v != "fast" {
+		t.Errorf("expected case-insensitive enum match, got %v %+v", v, issue)
+	}
+	if _, issue := checkSchemaValue("mode", "medium", enumProp); issue == nil || !strings.Contains(issue.Expected, "fast | slow") {
+		t.Errorf("expected enum issue listing options, got %+v", issue)
+	}
+
+	rangeProp := map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 5}
+	if _, issue := checkSchemaValue("n", 9.0, rangeProp); issue == nil {
+		t.Error("expected range issue for 9 > 5")
+	}
+	if _, issue := checkSchemaValue("n", 2.5, rangeProp); issue == nil {
+		t.Error("expected integer issue for 2.5")
+	}
+
+	arrProp := map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "number"}}
+	v, issue := checkSchemaValue("xs", `["1", 2]`, arrProp)
+	if issue != nil {
+		t.Fatalf("unexpected issue: %+v", issue)
+	}
+	if arr := v.([]interface{}); len(arr) != 2 || arr[0] != 1.0 {
+		t.Errorf("expected JSON string array with coerced items, got %#v", v)
+	}
+	if v, _ := checkSchemaValue("xs", "solo", map[string]interface{}{"type": "array"}); len(v.([]interface{})) != 1 {
+		t.Errorf("expected bare value wrapped in array, got %#v", v)
+	}
+	if v, _ := checkSchemaValue("flag", "true", map[string]interface{}{"type": "boolean"}); v != true {
+		t.Errorf("expected 'true' coerced to bool, got %#v", v)
+	}
+}
+
+func TestExecuteTool_InvalidArgsCountedPerModel(t *testing.T) {
+	cfg := &Config{ModelName: "count-model", Providers: []Provider{{Name: "default", Model: "count-model"}}}
+	agent := &Agent{config: cfg}
+	before := toolArgFailureStats()["web_fetch"]["count-model"]
+
+	_, err := agent.executeTool("web_fetch", map[string]interface{}{})
+	var argErr *ToolArgError
+	if err == nil || !errors.As(err, &argErr) {
+		t.Fatalf("expected ToolArgError, got %v", err)
+	}
+	if got := toolArgFailureStats()["web_fetch"]["count-model"]; got != before+1 {
+		t.Errorf("expected failure count %d, got %d", before+1, got)
+	}
+}
+
+func TestValidateToolArgs_PluginSchema(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	var params map[string]interface{}
+	json.Unmarshal([]byte(`{"type":"object","properties":{"unit":{"type":"string","enum":["c","f"]}},"required":["unit"]}`), &params)
+	pluginMu.Lock()
+	loadedPlugins = []Plugin{{Name: "temp", Tool: &PluginTool{Parameters: params}}}
+	pluginMu.Unlock()
+
+	if _, verr := validateToolArgs("plugin_temp", map[string]interface{}{"unit": "k"}); verr == nil {
+		t.Error("expected enum violation for plugin tool")
+	}
+	if args, verr := validateToolArgs("plugin_temp", map[string]interface{}{"unit": "C"}); verr != nil || args["unit"] != "c" {
+		t.Errorf("expected plugin arg accepted and normalized, got %v %v", args, verr)
+	}
+}
+
+func TestSearchTokens_CJKBigrams(t *testing.T) {
+	t.Parallel()
+	got := searchTokens("Docker上でweb_searchを使う")
+	want := []string{"docker", "上で", "web_search", "web", "search", "を使", "使う"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func toolNames(ts []Tool) map[string]bool {
+	names := make(map[string]bool)
+	for _, t := range ts {
+		names[t.Name] = true
+	}
+	return names
+}
+
+func TestSelectToolsForContext_Retrieval(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	cfg := &Config{}
+	selected := toolNames(selectToolsForContext([]Message{{Role: "user", Content: "コンテナでffmpegを動かして"}}, cfg, ""))
+	if !selected["docker_exec"] {
+		t.Error("expected docker_exec selected for a container/ffmpeg request")
+	}
+	if selected["twitter_timeline"] {
+		t.Error("twitter_timeline should not be selected for an unrelated request")
+	}
+	for name := range coreToolNames {
+		if !selected[name] {
+			t.Errorf("core tool %s should always be selected", name)
+		}
+	}
+}
+
+func TestSelectToolsForContext_PluginByDescription(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	pluginMu.Lock()
+	loadedPlugins = []Plugin{{Name: "weather", Tool: &PluginTool{
+		Description: "天気予報を取得する (weather forecast)",
+		Parameters:  map[string]interface{}{"type": "object"},
+	}}}
+	pluginMu.Unlock()
+
+	selected := toolNames(selectToolsForContext([]Message{{Role: "user", Content: "明日の天気予報は？"}}, &Config{}, ""))
+	if !selected["plugin_weather"] {
+		t.Error("expected plugin tool selected by description similarity")
+	}
+}
+
+func TestSelectToolsForContext_BudgetAndCalledTools(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	cfg := &Config{
+		Providers:        []Provider{{Name: "default", Model: "big"}},
+		MaxToolsPerModel: map[string]int{"tiny": 1},
+	}
+	messages := []Message{
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "1", Function: ToolCallFunc{Name: "self_status"}}}},
+		{Role: "user", Content: "twitter timeline and docker"},
+	}
+	// The budget follows the model the request goes to, not the primary one
+	selected := toolNames(selectToolsForContext(messages, cfg, "tiny"))
+	if !selected["self_status"] {
+		t.Error("previously called tool should stay selected")
+	}
+	if selected["twitter_timeline"] || selected["docker_exec"] {
+		t.Error("budget of 1 is already used by core tools; retrieved tools should be skipped")
+	}
+	if cfg.maxToolsFor("other") != defaultMaxTools {
+		t.Errorf("expected default budget for unknown model")
+	}
+}
+
+func TestSelectToolsForContext_Embeddings(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	// Query and twitter_timeline get the same vector; everything else is orthogonal.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var data []map[string]interface{}
+		for i, in := range req.Input {
+			vec := []float64{0, 1}
+			if strings.HasPrefix(in, "twitter_timeline") || in == "ぼくのTLどうなってる" {
+				vec = []float64{1, 0}
+			}
+			data = append(data, map[string]interface{}{"index": i, "embedding": vec})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cfg := testConfig(server.URL)
+	cfg.ToolEmbeddingModel = "embed-test"
+	selected := toolNames(selectToolsForContext([]Message{{Role: "user", Content: "ぼくのTLどうなってる"}}, cfg, ""))
+	if !selected["twitter_timeline"] {
+		t.Error("expected twitter_timeline selected via embedding similarity")
+	}
+}
+
+func TestEmbeddingCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	embeddingCacheMu.Lock()
+	defer embeddingCacheMu.Unlock()
+	cacheEmbedding("lru-test\x00first", []float64{1})
+	cacheEmbedding("lru-test\x00second", []float64{2})
+	cachedEmbedding("lru-test\x00first")
+	for i := 0; i < embeddingCacheSize-1; i++ {
+		cacheEmbedding(fmt.Sprintf("lru-test\x00filler-%d", i), []float64{0})
+	}
+	if embeddingLRU.Len() != embeddingCacheSize || len(embeddingCache) != embeddingCacheSize {
+		t.Errorf("expected cache capped at %d, got %d/%d", embeddingCacheSize, embeddingLRU.Len(), len(embeddingCache))
+	}
+	if _, ok := cachedEmbedding("lru-test\x00second"); ok {
+		t.Error("least recently used vector should be evicted")
+	}
+	if v, ok := cachedEmbedding("lru-test\x00first"); !ok || v[0] != 1 {
+		t.Error("recently used vector should stay cached")
+	}
+}
+
+func withTestSkills(t *testing.T, skills []Skill) {
+	t.Helper()
+	skillsMu.Lock()
+	orig := loadedSkills
+	loadedSkills = skills
+	skillsMu.Unlock()
+	t.Cleanup(func() {
+		skillsMu.Lock()
+		loadedSkills = orig
+		skillsMu.Unlock()
+	})
+}
+
+func TestRouteSkills(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	withTestSkills(t, []Skill{
+		{Name: "systematic-debugging", Description: "Use when debugging a bug, crash or test failure",
+			Content: "---\nname: systematic-debugging\n---\n# Debugging\nReproduce the bug first.\n"},
+		{Name: "brainstorming", Description: "アイデア出し・ブレインストーミングをするとき",
+			Content: "---\nname: brainstorming\n---\n# Brainstorm\n" + strings.Repeat("質問をひとつずつ聞く。\n", 400)},
+	})
 
-	body := `{"action":"set_providers","providers":[{"name":"new","backend":"openai","endpoint":"https://api.openai.com/v1","model":"gpt-4","api_key":"sk-test"}]}`
-	req := httptest.NewRequest("POST", "/api/settings", strings.NewReader(body))
-	req.Header.Set("Content-Type", "application/json")
-	w := httptest.NewRecorder()
-	ws.handleSettings(w, req)
+	acts, ctx := routeSkills(&Config{}, "the test crashes with a nil pointer, help me debug this bug", nil)
+	if len(acts) != 1 || acts[0].Name != "systematic-debugging" {
+		t.Fatalf("expected debugging skill, got %+v", acts)
+	}
+	if !strings.Contains(ctx, "Reproduce the bug first.") || strings.Contains(ctx, "name: systematic-debugging") {
+		t.Errorf("expected SKILL.md body without frontmatter, got %q", ctx)
+	}
 
-	if w.Code != 200 {
-		t.Errorf("expected 200, got %d: %s", w.Code, w.Body.String())
+	acts, ctx = routeSkills(&Config{SkillTokenBudget: 200}, "新しいアイデアをブレインストーミングしたい", nil)
+	if len(acts) != 1 || acts[0].Name != "brainstorming" || !acts[0].Truncated {
+		t.Fatalf("expected truncated brainstorming skill, got %+v", acts)
 	}
-	if len(cfg.Providers) != 1 || cfg.Providers[0].Name != "new" {
-		t.Errorf("providers not updated: %+v", cfg.Providers)
+	if acts[0].Tokens > 200 || estimateTokens(ctx) > 300 {
+		t.Errorf("skill context exceeds budget: %d tokens", estimateTokens(ctx))
+	}
+
+	if acts, _ := routeSkills(&Config{}, "what's the weather tomorrow", nil); len(acts) != 0 {
+		t.Errorf("expected no skill for unrelated message, got %+v", acts)
+	}
+	withTestSkills(t, []Skill{{Name: "systematic-debugging", Description: "Use when debugging a bug, crash or test failure", Content: "steps"}})
+	if acts, _ := routeSkills(&Config{}, "debug this crash", nil); len(acts) != 1 {
+		t.Error("a single installed skill should still be routed")
+	}
+	if acts, _ := routeSkills(&Config{SkillRouterDisabled: true}, "debug this bug", nil); len(acts) != 0 {
+		t.Error("router should be off when disabled in config")
+	}
+
+	agent := &Agent{config: &Config{}, messages: []Message{{Role: "system", Content: "base"}, {Role: "user", Content: "debug this crash bug"}}}
+	agent.activateSkills("debug this crash bug")
+	msgs := agent.requestMessages()
+	if !strings.Contains(msgs[0].Content, "### Skill: systematic-debugging") || agent.messages[0].Content != "base" {
+		t.Error("skill context should be added to the request only, not the stored conversation")
 	}
 }
 
-func TestHandleDockerStatus(t *testing.T) {
+func TestRouteSkills_ThreadOverrides(t *testing.T) {
 	cleanup := setupTestDirs(t)
 	defer cleanup()
+	withTestSkills(t, []Skill{
+		{Name: "systematic-debugging", Description: "Use when debugging a bug", Content: "debug steps"},
+		{Name: "writing-plans", Description: "Use when writing an implementation plan", Content: "plan steps"},
+	})
+	saveThreadMeta(&Thread{ID: "sk1", Title: "t", CreatedAt: time.Now(), UpdatedAt: time.Now()})
+	ws := NewWebServer(&Config{})
 
-	server := mockLLMServer(t, staticLLMResponse("ok"))
-	defer server.Close()
-	ws := NewWebServer(testConfig(server.URL))
-
-	req := httptest.NewRequest("GET", "/api/docker/status", nil)
 	w := httptest.NewRecorder()
-	ws.handleDockerStatus(w, req)
-
+	ws.handleThreads(w, httptest.NewRequest("POST", "/api/threads/sk1/skills",
+		strings.NewReader(`{"pinned": ["writing-plans"], "disabled": ["systematic-debugging"]}`)))
 	if w.Code != 200 {
-		t.Errorf("expected 200, got %d", w.Code)
+		t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
 	}
-	var resp map[string]interface{}
-	json.NewDecoder(w.Body).Decode(&resp)
-	if _, ok := resp["docker_available"]; !ok {
-		t.Error("expected 'docker_available' field in response")
+	w = httptest.NewRecorder()
+	ws.handleThreads(w, httptest.NewRequest("POST", "/api/threads/sk1/skills", strings.NewReader(`{"pinned": ["nope"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown skill, got %d", w.Code)
+	}
+
+	thread, _ := loadThreadMeta("sk1")
+	acts, ctx := routeSkills(&Config{}, "debug this bug", thread)
+	if len(acts) != 1 || acts[0].Name != "writing-plans" || acts[0].Reason != "pinned" {
+		t.Fatalf("expected pinned skill only, got %+v", acts)
+	}
+	if strings.Contains(ctx, "debug steps") {
+		t.Error("disabled skill must not be injected")
+	}
+
+	thread.PinnedSkills = nil
+	if acts, _ := routeSkills(&Config{}, "debug this bug", thread); len(acts) != 0 {
+		t.Errorf("disabled skill should not be routed, got %+v", acts)
 	}
 }
 
-// ============================================================================
-// 9. Agent / LLM Tests
-// ============================================================================
+func TestParseSkillFrontmatter(t *testing.T) {
+	content := `---
+name: report
+description: "Write a report: summary first"
+version: 1.2.0
+allowed-tools: [web_search, web_fetch]
+model: gpt-oss:20b
+route: plan
+requires:
+  - brainstorming
+arguments:
+  - name: language
+    description: Output language
+    default: ja
+  - name: topic
+    required: true
+---
+# Report
+Write about {topic} in {language}. Files live in {baseDir}.
+`
+	s, errs := parseSkillFrontmatter(content)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if s.Name != "report" || s.Description != "Write a report: summary first" || s.Version != "1.2.0" {
+		t.Errorf("unexpected scalars: %+v", s)
+	}
+	if strings.Join(s.AllowedTools, ",") != "web_search,web_fetch" || s.Model != "gpt-oss:20b" || s.Route != "plan" {
+		t.Errorf("unexpected hints: %+v", s)
+	}
+	if len(s.Requires) != 1 || s.Requires[0] != "brainstorming" {
+		t.Errorf("unexpected requires: %v", s.Requires)
+	}
+	if len(s.Arguments) != 2 || s.Arguments[0].Default != "ja" || !s.Arguments[1].Required {
+		t.Fatalf("unexpected arguments: %+v", s.Arguments)
+	}
 
-func TestAgentChat_SimpleResponse(t *testing.T) {
-	server := mockLLMServer(t, staticLLMResponse("Hello from mock!"))
-	defer server.Close()
+	s.Content = content
+	if _, err := renderSkillContent(s, nil); err == nil || !strings.Contains(err.Error(), "topic") {
+		t.Errorf("expected missing required argument error, got %v", err)
+	}
+	out, err := renderSkillContent(s, map[string]string{"topic": "GPUs"})
+	if err != nil || !strings.HasPrefix(out, "# Report\nWrite about GPUs in ja.") || strings.Contains(out, "{baseDir}") {
+		t.Errorf("unexpected rendering: %q %v", out, err)
+	}
 
-	cfg := testConfig(server.URL)
-	agent := &Agent{
-		config:   cfg,
-		messages: []Message{{Role: "system", Content: "test"}},
+	// Comma-separated tools and name: default argument maps
+	s, _ = parseSkillFrontmatter("---\nname: x\nallowed-tools: read_file, grep\narguments:\n  lang: en\n---\nbody")
+	if len(s.AllowedTools) != 2 || s.AllowedTools[1] != "grep" || len(s.Arguments) != 1 || s.Arguments[0].Default != "en" {
+		t.Errorf("unexpected parse: %+v", s)
 	}
 
-	agent.messages = append(agent.messages, Message{Role: "user", Content: "hi"})
-	resp, err := agent.chat(context.Background())
-	if err != nil {
+	_, errs = parseSkillFrontmatter("---\nname: x\n  stray: indent\nnot a field\n---\n")
+	if len(errs) != 2 {
+		t.Errorf("expected 2 syntax errors, got %v", errs)
+	}
+}
+
+func TestSkillIssuesAndAllowedTools(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	s := Skill{Name: "bad", Version: "one", Route: "fast", AllowedTools: []string{"web_search", "no_such_tool", "plugin_*"},
+		Requires: []string{"missing"}, Arguments: []SkillArgument{{Name: "a"}, {Name: "a"}, {Name: "b c"}}}
+	issues := strings.Join(skillIssues(s, []Skill{s}), "\n")
+	for _, want := range []string{"semantic version", "unknown route", `unknown tool "no_such_tool"`, `requires skill "missing"`, "declared twice", `"b c" is invalid`} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("expected issue %q in:\n%s", want, issues)
+		}
+	}
+	if strings.Contains(issues, "plugin_*") || strings.Contains(issues, `"web_search"`) {
+		t.Errorf("known tools and patterns should pass: %s", issues)
+	}
+
+	withTestSkills(t, []Skill{{Name: "reader", Description: "read files", AllowedTools: []string{"read_file", "grep"}, Model: "small-model",
+		Content: "---\nname: reader\n---\nRead carefully."}})
+	agent := &Agent{config: &Config{}, messages: []Message{{Role: "user", Content: "hi"}}}
+	if _, err := agent.executeTool("use_skill", map[string]interface{}{"name": "reader"}); err != nil {
 		t.Fatal(err)
 	}
-	if resp.Content != "Hello from mock!" {
-		t.Errorf("expected 'Hello from mock!', got %q", resp.Content)
+	selected := toolNames(agent.restrictToSkillTools(selectToolsForContext(agent.messages, agent.config, agent.requestModel())))
+	if len(selected) != 2 || !selected["read_file"] || !selected["grep"] {
+		t.Errorf("expected only the skill's allowed tools, got %v", selected)
+	}
+	if agent.requestModel() != "small-model" {
+		t.Errorf("expected model hint, got %s", agent.requestModel())
 	}
-}
 
-func TestAgentChat_ServerError(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "internal error", 500)
-	}))
+	// The response check goes to the hinted model too
+	var checked string
+	server := mockLLMServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		checked = req.Model
+		staticLLMResponse("OK")(w, r)
+	})
 	defer server.Close()
+	agent.config = testConfig(server.URL)
+	if ok, _ := agent.validateResponse(context.Background(), "hi", "hello"); !ok || checked != "small-model" {
+		t.Errorf("expected validation by the hinted model, got %q", checked)
+	}
 
-	cfg := testConfig(server.URL)
-	agent := &Agent{
-		config:   cfg,
-		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "hi"}},
+	// Patterns only filter the selection; exact names are added back
+	agent.skillTools = []string{"read_file", "web_*"}
+	selected = toolNames(agent.restrictToSkillTools([]Tool{{Name: "web_search"}, {Name: "write_file"}}))
+	if len(selected) != 2 || !selected["web_search"] || !selected["read_file"] {
+		t.Errorf("expected selected pattern matches plus named tools, got %v", selected)
 	}
 
-	_, err := agent.chat(context.Background())
-	if err == nil {
-		t.Error("expected error for 500 response")
+	// A new turn without the skill clears the hints
+	agent.activateSkills("hello there")
+	if agent.skillTools != nil || agent.skillModel != "" {
+		t.Error("skill hints should reset each turn")
 	}
 }
 
-func TestAgentChatStream_BasicContent(t *testing.T) {
-	chunks := []string{"Hello", " ", "World", "!"}
-	server := mockLLMServer(t, streamingLLMResponse(chunks))
-	defer server.Close()
+func TestRunSkillScript(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
 
-	cfg := testConfig(server.URL)
-	agent := &Agent{
-		config:   cfg,
-		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "hi"}},
+	dir := filepath.Join(t.TempDir(), "counter")
+	os.MkdirAll(filepath.Join(dir, "scripts"), 0755)
+	content := `---
+name: counter
+description: Count things
+scripts:
+  - name: count
+    file: scripts/count.sh
+    description: Print numbers up to N
+    timeout: 10
+permissions:
+  env: SIKI_TEST_TOKEN
+  memory_mb: 256
+---
+Use the count script.
+`
+	os.WriteFile(filepath.Join(dir, "SKILL.md"), []byte(content), 0644)
+	os.WriteFile(filepath.Join(dir, "scripts", "count.sh"),
+		[]byte("i=1\nwhile [ $i -le \"$1\" ]; do echo \"line $i\"; i=$((i+1)); done\necho \"home=$HOME token=$SIKI_TEST_TOKEN dir=$(basename \"$SIKI_SKILL_DIR\")\"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "scripts", "other.sh"), []byte("echo other\n"), 0644)
+
+	skill, errs := parseSkillFrontmatter(content)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(skill.Scripts) != 1 || skill.Scripts[0].Timeout != 10 || skill.Permissions == nil || skill.Permissions.MemoryMB != 256 {
+		t.Fatalf("unexpected scripts/permissions: %+v %+v", skill.Scripts, skill.Permissions)
 	}
+	skill.Content, skill.Dir = content, dir
+	withTestSkills(t, []Skill{skill})
+	if issues := skillIssues(skill, []Skill{skill}); len(issues) != 0 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+	t.Setenv("SIKI_TEST_TOKEN", "tok")
 
-	var collected []string
-	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
-		OnContent: func(s string) { collected = append(collected, s) },
-	})
+	var progress []string
+	agent := &Agent{config: &Config{}, sendEvent: func(ev StreamEvent) {
+		if ev.Type == "progress" && ev.Name == "run_skill_script" {
+			progress = append(progress, ev.Content)
+		}
+	}}
+	out, err := agent.executeTool("run_skill_script", map[string]interface{}{"skill": "counter", "script": "count", "args": []interface{}{"3"}})
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("run_skill_script failed: %v", err)
 	}
-	if resp.Content != "Hello World!" {
-		t.Errorf("expected 'Hello World!', got %q", resp.Content)
+	if !strings.HasPrefix(out, "line 1\nline 2\nline 3\n") || !strings.Contains(out, "token=tok") || !strings.Contains(out, "dir=skill") {
+		t.Errorf("unexpected output: %q", out)
 	}
-	if len(collected) == 0 {
-		t.Error("OnContent should have been called")
+	if strings.Contains(out, "home="+os.Getenv("HOME")+" ") {
+		t.Error("script should not run with the real HOME")
+	}
+	if len(progress) != 4 || progress[0] != "line 1" {
+		t.Errorf("expected each output line as progress, got %v", progress)
+	}
+
+	if _, err := agent.executeTool("run_skill_script", map[string]interface{}{"skill": "counter", "script": "other"}); err == nil {
+		t.Error("undeclared script should be rejected when entrypoints are declared")
+	}
+
+	// Without declared entrypoints, files under scripts/ may run, nothing outside
+	bare := Skill{Name: "bare", Dir: dir}
+	if _, err := bare.findScript("other.sh"); err != nil {
+		t.Errorf("expected scripts/other.sh runnable: %v", err)
+	}
+	if _, err := bare.findScript("../../etc/passwd"); err == nil {
+		t.Error("path traversal must be rejected")
+	}
+
+	agent.applySkillHints(skill)
+	if !toolNames(agent.restrictToSkillTools(nil))["run_skill_script"] {
+		t.Error("run_skill_script should be offered while a skill with scripts is active")
 	}
 }
 
-func TestAgentChatStream_ThinkTags(t *testing.T) {
-	chunks := []string{"<think>reasoning here</think>The answer is 42."}
-	server := mockLLMServer(t, streamingLLMResponse(chunks))
-	defer server.Close()
+func TestSkillLockfileUpdateAndPin(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+	t.Setenv("HOME", t.TempDir())
+	withTestSkills(t, nil)
 
-	cfg := testConfig(server.URL)
-	agent := &Agent{
-		config:   cfg,
-		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "meaning of life?"}},
+	// A skills collection in a local directory
+	src := t.TempDir()
+	writeSkill := func(name, body string) {
+		os.MkdirAll(filepath.Join(src, "skills", name), 0755)
+		os.WriteFile(filepath.Join(src, "skills", name, "SKILL.md"),
+			[]byte("---\nname: "+name+"\nversion: 1.0.0\ndescription: test skill\n---\n"+body), 0644)
 	}
+	writeSkill("alpha", "# Alpha\nstep one\nstep two\n")
+	writeSkill("beta", "# Beta\n")
+	os.WriteFile(filepath.Join(src, "README.md"), []byte("docs"), 0644)
 
-	var thinkParts []string
-	var contentParts []string
-	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
-		OnContent:  func(s string) { contentParts = append(contentParts, s) },
-		OnThinking: func(s string) { thinkParts = append(thinkParts, s) },
-	})
+	entries, err := installSkills(src, PluginInstallOptions{}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.Thinking != "reasoning here" {
-		t.Errorf("expected thinking 'reasoning here', got %q", resp.Thinking)
+	if len(entries) != 2 || getSkillByName("alpha") == nil {
+		t.Fatalf("expected alpha and beta installed, got %+v", entries)
 	}
-	if resp.Content != "The answer is 42." {
-		t.Errorf("expected content 'The answer is 42.', got %q", resp.Content)
+	lock := loadSkillLock()
+	if e := lock["alpha"]; e.Source.Type != "dir" || filepath.Base(e.Path) != "alpha" || e.Version != "1.0.0" || e.Source.SHA256 == "" || e.Source.InstalledAt.IsZero() {
+		t.Errorf("unexpected lock entry: %+v", e)
 	}
-}
 
-func TestHandleStreamingResponse_ThinkTagAcrossChunks(t *testing.T) {
-	// Simulate <think> tag content split across SSE chunks
-	// Split: "<think>reas" | "oning</think>answer"
-	chunks := []string{"<think>reas", "oning</think>answer"}
-	server := mockLLMServer(t, streamingLLMResponse(chunks))
-	defer server.Close()
+	// Nothing changed upstream yet
+	updates, err := updateSkills(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range updates {
+		if u.Status != "unchanged" {
+			t.Errorf("expected unchanged, got %+v", u)
+		}
+	}
 
-	cfg := testConfig(server.URL)
-	agent := &Agent{
-		config:   cfg,
-		messages: []Message{{Role: "system", Content: "test"}, {Role: "user", Content: "test"}},
+	// Upstream edit: dry run previews the SKILL.md diff without applying it
+	writeSkill("alpha", "# Alpha\nstep one\nstep 2\n")
+	updates, err = updateSkills([]string{"alpha"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 1 || updates[0].Status != "available" || !strings.Contains(updates[0].Diff, "-step two\n+step 2") {
+		t.Fatalf("expected a diff preview, got %+v", updates)
+	}
+	if strings.Contains(getSkillByName("alpha").Content, "step 2") {
+		t.Error("dry run must not change the installed skill")
+	}
+	if _, err := updateSkills(nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(getSkillByName("alpha").Content, "step 2") {
+		t.Error("update should install the new SKILL.md")
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(skillsDir(), ".alpha-*")); len(leftovers) != 0 {
+		t.Errorf("expected staging dirs to be cleaned up, got %v", leftovers)
 	}
 
-	var contentParts []string
-	var thinkParts []string
-	resp, err := agent.chatStream(context.Background(), StreamCallbacks{
-		OnContent:  func(s string) { contentParts = append(contentParts, s) },
-		OnThinking: func(s string) { thinkParts = append(thinkParts, s) },
-	})
+	// Pinned skills are skipped
+	if _, err := pinSkill("beta", "", true); err != nil {
+		t.Fatal(err)
+	}
+	writeSkill("beta", "# Beta v2\n")
+	updates, _ = updateSkills([]string{"beta"}, false)
+	if len(updates) != 1 || updates[0].Status != "pinned" || strings.Contains(getSkillByName("beta").Content, "v2") {
+		t.Errorf("pinned skill should not update: %+v", updates)
+	}
+	if _, err := pinSkill("beta", "", false); err != nil {
+		t.Fatal(err)
+	}
+	updates, _ = updateSkills([]string{"beta"}, false)
+	if len(updates) != 1 || updates[0].Status != "updated" {
+		t.Errorf("unpinned skill should update: %+v", updates)
+	}
+
+	// A zip holding a single skill in a wrapping directory
+	zipPath := filepath.Join(t.TempDir(), "gamma.zip")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.Create("gamma-main/SKILL.md")
+	fw.Write([]byte("---\nname: gamma\ndescription: zipped\n---\n# Gamma\n"))
+	fw, _ = zw.Create("gamma-main/scripts/run.sh")
+	fw.Write([]byte("echo hi\n"))
+	zw.Close()
+	os.WriteFile(zipPath, buf.Bytes(), 0644)
+	entries, err = installSkills(zipPath, PluginInstallOptions{}, false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.Thinking != "reasoning" {
-		t.Errorf("expected thinking 'reasoning', got %q", resp.Thinking)
+	if len(entries) != 1 || entries[0].Path != "." || entries[0].Source.Type != "archive" {
+		t.Fatalf("unexpected zip install: %+v", entries)
 	}
-	if resp.Content != "answer" {
-		t.Errorf("expected content 'answer', got %q", resp.Content)
+	if _, err := os.Stat(filepath.Join(skillsDir(), "gamma", "scripts", "run.sh")); err != nil {
+		t.Errorf("skill files should be copied: %v", err)
+	}
+
+	if err := removeSkill("gamma"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadSkillLock()["gamma"]; ok || getSkillByName("gamma") != nil {
+		t.Error("remove should drop the skill and its lock entry")
+	}
+	if err := removeSkill("../etc"); err == nil {
+		t.Error("expected invalid name error")
 	}
 }
 
@@ -1659,6 +4843,152 @@ func TestWebServer_GetOrCreateAgent_FixesIncomplete(t *testing.T) {
 	}
 }
 
+func TestOpenAIModels(t *testing.T) {
+	ws := NewWebServer(&Config{})
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	w := httptest.NewRecorder()
+	ws.handleOpenAIModels(w, req)
+
+	var resp struct {
+		Object string `json:"object"`
+		Data   []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Object != "list" || len(resp.Data) != 2 {
+		t.Fatalf("unexpected models response: %+v", resp)
+	}
+	if resp.Data[0].ID != "siki-agent" || resp.Data[1].ID != "siki-plan" {
+		t.Errorf("unexpected model IDs: %+v", resp.Data)
+	}
+}
+
+func TestOpenAIChatCompletions_NonStreaming(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, streamingLLMResponse([]string{"OpenAI", " hello"}))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	body := `{"model":"siki-agent","messages":[{"role":"user","content":"hi"}],"user":"alice"}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ws.handleOpenAIChatCompletions(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp OpenAIChatResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Object != "chat.completion" || len(resp.Choices) != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if resp.Choices[0].Message.Content != "OpenAI hello" {
+		t.Errorf("expected content 'OpenAI hello', got %q", resp.Choices[0].Message.Content)
+	}
+	// Keyed by the user field, so the thread persists
+	msgs, _ := loadThreadMessages("openai-alice")
+	if len(msgs) < 2 {
+		t.Errorf("expected thread openai-alice to be saved, got %d messages", len(msgs))
+	}
+}
+
+func TestOpenAIChatCompletions_Streaming(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, streamingLLMResponse([]string{"Hello", " stream"}))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	body := `{"model":"siki-agent","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("X-Siki-Conversation-Id", "oa-stream")
+	w := newFlushRecorder()
+	ws.handleOpenAIChatCompletions(w, req)
+
+	result := w.Body.String()
+	if !strings.Contains(result, `"object":"chat.completion.chunk"`) {
+		t.Error("expected chat.completion.chunk events")
+	}
+	if !strings.Contains(result, `"content":"Hello"`) {
+		t.Errorf("expected content delta, got: %s", result)
+	}
+	if !strings.Contains(result, `"finish_reason":"stop"`) || !strings.HasSuffix(result, "data: [DONE]\n\n") {
+		t.Error("expected stop chunk followed by [DONE]")
+	}
+	if _, err := loadThreadMeta("oa-stream"); err != nil {
+		t.Errorf("expected thread keyed by header: %v", err)
+	}
+}
+
+func TestOpenAIChatCompletions_Stateless(t *testing.T) {
+	cleanup := setupTestDirs(t)
+	defer cleanup()
+
+	server := mockLLMServer(t, streamingLLMResponse([]string{"ok"}))
+	defer server.Close()
+	ws := NewWebServer(testConfig(server.URL))
+
+	body := `{"model":"siki-agent","messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"again"}]}`
+	w := httptest.NewRecorder()
+	ws.handleOpenAIChatCompletions(w, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != 200 || w.Header().Get(openAIConversationHeader) != "" {
+		t.Fatalf("expected stateless reply without a thread id, got %d %q", w.Code, w.Header().Get(openAIConversationHeader))
+	}
+	if items, _ := listThreads(); len(items) != 0 {
+		t.Errorf("stateless requests must not create threads: %+v", items)
+	}
+	if len(ws.conversations) != 0 {
+		t.Errorf("stateless agents must not be kept: %d", len(ws.conversations))
+	}
+}
+
+func TestOpenAIChatCompletions_UnknownModel(t *testing.T) {
+	ws := NewWebServer(&Config{})
+	body := `{"model":"gpt-4","messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ws.handleOpenAIChatCompletions(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown model, got %d", w.Code)
+	}
+}
+
+func TestOpenAIMessageText(t *testing.T) {
+	text, images := openAIMessageText(json.RawMessage(`"plain"`))
+	if text != "plain" || images != nil {
+		t.Errorf("string content: got %q %v", text, images)
+	}
+	text, images = openAIMessageText(json.RawMessage(`[{"type":"text","text":"look"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAA"}},{"type":"image_url","image_url":{"url":"https://x/y.png"}}]`))
+	if text != "look" || len(images) != 1 {
+		t.Errorf("parts content: got %q %v", text, images)
+	}
+}
+
+func TestOpenAIEventText(t *testing.T) {
+	if c, r := openAIEventText(StreamEvent{Type: "content", Content: "a"}); c != "a" || r != "" {
+		t.Errorf("content event: %q %q", c, r)
+	}
+	if c, r := openAIEventText(StreamEvent{Type: "tool_start", Name: "web_search"}); c != "" || !strings.Contains(r, "web_search") {
+		t.Errorf("tool_start should map to reasoning: %q %q", c, r)
+	}
+	if c, r := openAIEventText(StreamEvent{Type: "suggestions"}); c != "" || r != "" {
+		t.Errorf("suggestions should be dropped: %q %q", c, r)
+	}
+}
+
+func TestPipelineForcesPlan(t *testing.T) {
+	if pipelineForcesPlan(context.Background()) {
+		t.Error("background context should not force plan")
+	}
+	if !pipelineForcesPlan(withForcedPlan(context.Background())) {
+		t.Error("withForcedPlan should force plan")
+	}
+}
+
 // ============================================================================
 // 13. Conversation Search Tests
 // ============================================================================